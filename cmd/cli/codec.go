@@ -0,0 +1,258 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+	"github.com/pion/webrtc/v4/pkg/media/h264writer"
+	"github.com/pion/webrtc/v4/pkg/media/ivfwriter"
+
+	"github.com/pion/mediadevices"
+	"github.com/pion/mediadevices/pkg/codec"
+	"github.com/pion/mediadevices/pkg/codec/openh264"
+	"github.com/pion/mediadevices/pkg/codec/opus"
+	"github.com/pion/mediadevices/pkg/codec/vpx"
+)
+
+// Video codecs selectable with -video-codec, in the order they are offered
+// when not preferred
+var videoCodecNames = []string{"vp8", "vp9", "h264", "av1"}
+
+// Video codecs we can receive, by -video-codec name. The payload types are
+// the ones mediadevices stamps on the packets its encoders produce.
+var videoCodecs = map[string]*codec.RTPCodec{
+	"vp8":  codec.NewRTPVP8Codec(90000),
+	"vp9":  codec.NewRTPVP9Codec(90000),
+	"h264": codec.NewRTPH264Codec(90000),
+	"av1":  codec.NewRTPAV1Codec(90000),
+}
+
+// Payload types of the retransmission (RTX) stream of each video codec,
+// picked to stay clear of the ones above
+var videoRTXPayloadTypes = map[string]webrtc.PayloadType{
+	"vp8":  97,
+	"vp9":  100,
+	"h264": 126,
+	"av1":  101,
+}
+
+// Video encoders available in this build, by -video-codec name. AV1 needs
+// SVT-AV1 and is only compiled in with the av1 build tag (see codec_av1.go).
+var videoEncoders = map[string]func(MediaSettings) (codec.VideoEncoderBuilder, error){
+	"vp8": func(s MediaSettings) (codec.VideoEncoderBuilder, error) {
+		params, err := vpx.NewVP8Params()
+		s.applyVideo(&params.BaseParams)
+		return &params, err
+	},
+	"vp9": func(s MediaSettings) (codec.VideoEncoderBuilder, error) {
+		params, err := vpx.NewVP9Params()
+		s.applyVideo(&params.BaseParams)
+		return &params, err
+	},
+	"h264": func(s MediaSettings) (codec.VideoEncoderBuilder, error) {
+		params, err := openh264.NewParams()
+		s.applyVideo(&params.BaseParams)
+		if s.KeyFrameInterval > 0 {
+			params.IntraPeriod = uint(s.KeyFrameInterval)
+		}
+		return &params, err
+	},
+}
+
+// Opus frame durations, which are the only ones the codec allows
+var opusFrameDurations = []time.Duration{
+	2500 * time.Microsecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	20 * time.Millisecond,
+	40 * time.Millisecond,
+	60 * time.Millisecond,
+}
+
+// MediaSettings tunes local capture and encoding. Zero fields leave the
+// choice to the device or the encoder.
+type MediaSettings struct {
+	Width            int     // Pixels
+	Height           int     // Pixels
+	FrameRate        float64 // Frames per second
+	VideoBitrate     int     // Bits per second
+	KeyFrameInterval int     // Frames between keyframes
+	AudioBitrate     int     // Bits per second
+	OpusFrame        time.Duration
+	AudioChannels    int // 1 or 2
+}
+
+// Validate checks the settings that can be checked without a device
+func (s MediaSettings) Validate() error {
+	switch {
+	case s.Width < 0 || s.Height < 0:
+		return errors.New("-width and -height must not be negative")
+	case s.Width%2 != 0 || s.Height%2 != 0:
+		return errors.New("-width and -height must be even")
+	case s.FrameRate < 0 || s.FrameRate > 120:
+		return errors.New("-fps must be between 0 and 120")
+	case s.VideoBitrate < 0 || s.AudioBitrate < 0:
+		return errors.New("bitrates must not be negative")
+	case s.AudioBitrate != 0 && (s.AudioBitrate < 6000 || s.AudioBitrate > 510000):
+		return errors.New("-audio-bitrate must be between 6000 and 510000 for Opus")
+	case s.KeyFrameInterval < 0:
+		return errors.New("-keyframe-interval must not be negative")
+	case s.OpusFrame != 0 && !slices.Contains(opusFrameDurations, s.OpusFrame):
+		return fmt.Errorf("-opus-frame must be one of 2.5ms, 5ms, 10ms, 20ms, 40ms or 60ms, not %s", s.OpusFrame)
+	case s.AudioChannels != 0 && s.AudioChannels != 1 && s.AudioChannels != 2:
+		return errors.New("-audio-channels must be 1 or 2")
+	}
+	return nil
+}
+
+// applyVideo copies the video encoder settings into params
+func (s MediaSettings) applyVideo(params *codec.BaseParams) {
+	if s.VideoBitrate > 0 {
+		params.BitRate = s.VideoBitrate
+	}
+	if s.KeyFrameInterval > 0 {
+		params.KeyFrameInterval = s.KeyFrameInterval
+	}
+}
+
+// RTCP feedback negotiated for every video codec. NACKs are answered on the
+// RTX stream when the peer supports it.
+var videoRTCPFeedback = []webrtc.RTCPFeedback{
+	{Type: "goog-remb"},
+	{Type: "ccm", Parameter: "fir"},
+	{Type: "nack"},
+	{Type: "nack", Parameter: "pli"},
+}
+
+// videoCodecOrder returns every video codec name with preferred first
+func videoCodecOrder(preferred string) []string {
+	order := []string{preferred}
+	for _, name := range videoCodecNames {
+		if name != preferred {
+			order = append(order, name)
+		}
+	}
+	return order
+}
+
+// newCodecSelector returns the encoders for local media, tuned by settings.
+// Every video codec this build can encode is included, preferred first, so a
+// peer that doesn't support the preferred codec still gets video.
+func newCodecSelector(preferred string, settings MediaSettings) (*mediadevices.CodecSelector, error) {
+	if _, ok := videoCodecs[preferred]; !ok {
+		return nil, fmt.Errorf("unknown video codec %q (want %s)", preferred, strings.Join(videoCodecNames, ", "))
+	}
+	if _, ok := videoEncoders[preferred]; !ok {
+		return nil, fmt.Errorf("this build can't encode %s (rebuild with -tags %s)", preferred, preferred)
+	}
+
+	var encoders []codec.VideoEncoderBuilder
+	for _, name := range videoCodecOrder(preferred) {
+		newEncoder, ok := videoEncoders[name]
+		if !ok {
+			continue
+		}
+		encoder, err := newEncoder(settings)
+		if err != nil {
+			return nil, fmt.Errorf("failed to set up %s encoder: %w", name, err)
+		}
+		encoders = append(encoders, encoder)
+	}
+
+	opusParams, err := opus.NewParams()
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up Opus encoder: %w", err)
+	}
+	if settings.AudioBitrate > 0 {
+		opusParams.BitRate = settings.AudioBitrate
+	}
+	if settings.OpusFrame > 0 {
+		opusParams.Latency = opus.Latency(settings.OpusFrame)
+	}
+	return mediadevices.NewCodecSelector(
+		mediadevices.WithVideoEncoders(encoders...),
+		mediadevices.WithAudioEncoders(&opusParams),
+	), nil
+}
+
+// newAPI returns a WebRTC API whose SDP offers the video codecs with
+// preferred first, each with retransmission, followed by Opus audio.
+// Outgoing video adapts to the available bandwidth when congestion is set.
+func newAPI(preferred string, congestion *CongestionController) (*webrtc.API, error) {
+	m := &webrtc.MediaEngine{}
+	for _, name := range videoCodecOrder(preferred) {
+		params := videoCodecs[name].RTPCodecParameters
+		params.RTCPFeedback = videoRTCPFeedback
+		if err := m.RegisterCodec(params, webrtc.RTPCodecTypeVideo); err != nil {
+			return nil, fmt.Errorf("failed to register %s: %w", name, err)
+		}
+		rtx := webrtc.RTPCodecParameters{
+			RTPCodecCapability: webrtc.RTPCodecCapability{
+				MimeType:    webrtc.MimeTypeRTX,
+				ClockRate:   params.ClockRate,
+				SDPFmtpLine: fmt.Sprintf("apt=%d", params.PayloadType),
+			},
+			PayloadType: videoRTXPayloadTypes[name],
+		}
+		if err := m.RegisterCodec(rtx, webrtc.RTPCodecTypeVideo); err != nil {
+			return nil, fmt.Errorf("failed to register RTX for %s: %w", name, err)
+		}
+	}
+	if err := m.RegisterCodec(codec.NewRTPOpusCodec(48000).RTPCodecParameters, webrtc.RTPCodecTypeAudio); err != nil {
+		return nil, fmt.Errorf("failed to register Opus: %w", err)
+	}
+
+	ir := &interceptor.Registry{}
+	if congestion != nil {
+		if err := congestion.register(m, ir); err != nil {
+			return nil, fmt.Errorf("failed to set up congestion control: %w", err)
+		}
+	}
+	if err := webrtc.RegisterDefaultInterceptors(m, ir); err != nil {
+		return nil, err
+	}
+	return webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(ir)), nil
+}
+
+// Video MIME types written as IVF, keyed by lower case MIME type
+var ivfMimeTypesByName = map[string]string{
+	strings.ToLower(webrtc.MimeTypeVP8): webrtc.MimeTypeVP8,
+	strings.ToLower(webrtc.MimeTypeVP9): webrtc.MimeTypeVP9,
+	strings.ToLower(webrtc.MimeTypeAV1): webrtc.MimeTypeAV1,
+}
+
+// isVideoMimeType reports whether we know how to store video of mimeType
+func isVideoMimeType(mimeType string) bool {
+	_, ivf := ivfMimeTypesByName[strings.ToLower(mimeType)]
+	return ivf || strings.EqualFold(mimeType, webrtc.MimeTypeH264)
+}
+
+// videoFileExt returns the extension of files newVideoWriter writes for
+// mimeType
+func videoFileExt(mimeType string) string {
+	if strings.EqualFold(mimeType, webrtc.MimeTypeH264) {
+		return ".h264"
+	}
+	return ".ivf"
+}
+
+// newVideoWriter returns a writer that depacketizes RTP video of mimeType
+// into w: IVF for VP8, VP9 and AV1, or an Annex B byte stream for H.264.
+// Closing the writer closes w.
+func newVideoWriter(w io.Writer, mimeType string) (media.Writer, error) {
+	if strings.EqualFold(mimeType, webrtc.MimeTypeH264) {
+		return h264writer.NewWith(w), nil
+	}
+	canonical, ok := ivfMimeTypesByName[strings.ToLower(mimeType)]
+	if !ok {
+		return nil, fmt.Errorf("unsupported video codec %s", mimeType)
+	}
+	return ivfwriter.NewWith(w, ivfwriter.WithCodec(canonical))
+}
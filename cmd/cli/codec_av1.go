@@ -0,0 +1,18 @@
+//go:build av1
+
+package main
+
+import (
+	"github.com/pion/mediadevices/pkg/codec"
+	"github.com/pion/mediadevices/pkg/codec/svtav1"
+)
+
+// AV1 encoding links against SVT-AV1, so it is only built on request:
+// go build -tags av1 ./cmd/cli
+func init() {
+	videoEncoders["av1"] = func(s MediaSettings) (codec.VideoEncoderBuilder, error) {
+		params, err := svtav1.NewParams()
+		s.applyVideo(&params.BaseParams)
+		return &params, err
+	}
+}
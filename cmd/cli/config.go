@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// defaultICEServers is used when neither -ice-server, a config file nor the
+// signaling server provides any. Google only serves plain STUN on port 19302.
+var defaultICEServers = []webrtc.ICEServer{
+	{URLs: []string{
+		"stun:stun.l.google.com:19302",
+		"stun:stun1.l.google.com:19302",
+		"stun:stun2.l.google.com:19302",
+		"stun:stun3.l.google.com:19302",
+		"stun:stun4.l.google.com:19302",
+	}},
+}
+
+// ICEServerConfig is one entry of the "ice_servers" section of the config file
+type ICEServerConfig struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+}
+
+// FileConfig is the JSON config file passed with -config
+type FileConfig struct {
+	ICEServers         []ICEServerConfig `json:"ice_servers"`
+	ICETransportPolicy string            `json:"ice_transport_policy,omitempty"`
+}
+
+// loadFileConfig reads and parses the config file at path
+func loadFileConfig(path string) (*FileConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg FileConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	return &cfg, nil
+}
+
+// iceServerFlag collects repeated -ice-server flags. Each value is a stun:,
+// turn: or turns: URL, optionally carrying credentials as
+// "turn:username:credential@host:port?transport=tcp".
+type iceServerFlag []webrtc.ICEServer
+
+func (f *iceServerFlag) String() string {
+	var urls []string
+	for _, s := range *f {
+		urls = append(urls, s.URLs...)
+	}
+	return strings.Join(urls, ",")
+}
+
+func (f *iceServerFlag) Set(value string) error {
+	server, err := parseICEServer(value)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, server)
+	return nil
+}
+
+// parseICEServer splits optional "username:credential@" out of an ICE URL
+func parseICEServer(value string) (webrtc.ICEServer, error) {
+	scheme, rest, ok := strings.Cut(value, ":")
+	if !ok {
+		return webrtc.ICEServer{}, fmt.Errorf("invalid ICE server %q: missing scheme", value)
+	}
+
+	server := webrtc.ICEServer{}
+	if at := strings.LastIndex(rest, "@"); at >= 0 {
+		username, credential, _ := strings.Cut(rest[:at], ":")
+		server.Username = username
+		server.Credential = credential
+		rest = rest[at+1:]
+	}
+	server.URLs = []string{scheme + ":" + rest}
+
+	if err := validateICEServer(server); err != nil {
+		return webrtc.ICEServer{}, err
+	}
+	return server, nil
+}
+
+// validateICEServer checks the URL schemes and that TURN servers come with
+// credentials, so mistakes are reported at startup rather than as a silent
+// lack of relay candidates
+func validateICEServer(server webrtc.ICEServer) error {
+	if len(server.URLs) == 0 {
+		return fmt.Errorf("ICE server has no URLs")
+	}
+	for _, u := range server.URLs {
+		scheme, _, _ := strings.Cut(u, ":")
+		switch scheme {
+		case "stun", "stuns":
+		case "turn", "turns":
+			if server.Username == "" || server.Credential == "" {
+				return fmt.Errorf("TURN server %s requires a username and credential", u)
+			}
+		default:
+			return fmt.Errorf("unsupported ICE server scheme %q in %s", scheme, u)
+		}
+	}
+	return nil
+}
+
+// parseICETransportPolicy maps the -ice-transport-policy value to pion's type
+func parseICETransportPolicy(value string) (webrtc.ICETransportPolicy, error) {
+	switch value {
+	case "", "all":
+		return webrtc.ICETransportPolicyAll, nil
+	case "relay":
+		return webrtc.ICETransportPolicyRelay, nil
+	default:
+		return webrtc.ICETransportPolicyAll, fmt.Errorf("invalid ICE transport policy %q (want all or relay)", value)
+	}
+}
+
+// buildWebRTCConfig combines the config file and command line flags into the
+// configuration shared by every PeerConnection. Flags take precedence over
+// the file. If neither names any ICE servers the returned list is empty and
+// the caller falls back to the signaling server's or the built-in ones.
+func buildWebRTCConfig(file *FileConfig, flagServers []webrtc.ICEServer, flagPolicy string) (webrtc.Configuration, error) {
+	config := webrtc.Configuration{}
+
+	switch {
+	case len(flagServers) > 0:
+		config.ICEServers = flagServers
+	case file != nil && len(file.ICEServers) > 0:
+		for _, s := range file.ICEServers {
+			server := webrtc.ICEServer{URLs: s.URLs, Username: s.Username, Credential: s.Credential}
+			if err := validateICEServer(server); err != nil {
+				return config, err
+			}
+			config.ICEServers = append(config.ICEServers, server)
+		}
+	}
+
+	policy := flagPolicy
+	if policy == "" && file != nil {
+		policy = file.ICETransportPolicy
+	}
+	var err error
+	if config.ICETransportPolicy, err = parseICETransportPolicy(policy); err != nil {
+		return config, err
+	}
+
+	if config.ICETransportPolicy == webrtc.ICETransportPolicyRelay && len(config.ICEServers) > 0 && !hasTURNServer(config.ICEServers) {
+		return config, fmt.Errorf("ICE transport policy relay requires at least one turn: or turns: server")
+	}
+	return config, nil
+}
+
+func hasTURNServer(servers []webrtc.ICEServer) bool {
+	for _, s := range servers {
+		for _, u := range s.URLs {
+			if strings.HasPrefix(u, "turn:") || strings.HasPrefix(u, "turns:") {
+				return true
+			}
+		}
+	}
+	return false
+}
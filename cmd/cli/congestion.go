@@ -0,0 +1,177 @@
+package main
+
+import (
+	"log/slog"
+	"math"
+	"sync"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/interceptor/pkg/gcc"
+	"github.com/pion/webrtc/v4"
+
+	"github.com/pion/mediadevices"
+	"github.com/pion/mediadevices/pkg/codec"
+)
+
+// Video bitrates used by congestion control, in bits per second
+const (
+	initialVideoBitrate = 1_000_000 // Where the estimate starts
+	minVideoBitrate     = 100_000   // Never ask the encoder for less
+	defaultAudioBitrate = 48_000    // Left out of the estimate for audio
+)
+
+// Log the estimate again once it has moved this much (as a fraction)
+const estimateLogChange = 0.1
+
+// CongestionController runs Google Congestion Control (GCC) on every
+// PeerConnection, using transport-wide congestion control feedback from the
+// remote peer, and retunes the video encoders sending to that peer to the
+// bandwidth it estimates
+type CongestionController struct {
+	maxVideoBitrate int // 0 for no limit
+	audioBitrate    int
+
+	// Receives the estimator of each PeerConnection as it is created
+	estimators chan cc.BandwidthEstimator
+}
+
+// NewCongestionController returns a controller that keeps video within
+// settings.VideoBitrate, if set, and leaves room for audio at
+// settings.AudioBitrate
+func NewCongestionController(settings MediaSettings) *CongestionController {
+	c := &CongestionController{
+		maxVideoBitrate: settings.VideoBitrate,
+		audioBitrate:    settings.AudioBitrate,
+		estimators:      make(chan cc.BandwidthEstimator, 1),
+	}
+	if c.audioBitrate == 0 {
+		c.audioBitrate = defaultAudioBitrate
+	}
+	return c
+}
+
+// register adds the GCC interceptor, and the header extension its feedback
+// relies on, to the WebRTC API being built
+func (c *CongestionController) register(m *webrtc.MediaEngine, ir *interceptor.Registry) error {
+	initial := initialVideoBitrate
+	options := []gcc.Option{gcc.SendSideBWEMinBitrate(minVideoBitrate + c.audioBitrate)}
+	if c.maxVideoBitrate > 0 {
+		initial = min(initial, c.maxVideoBitrate)
+		options = append(options, gcc.SendSideBWEMaxBitrate(c.maxVideoBitrate+c.audioBitrate))
+	}
+	options = append(options, gcc.SendSideBWEInitialBitrate(initial+c.audioBitrate))
+
+	factory, err := cc.NewInterceptor(func() (cc.BandwidthEstimator, error) {
+		return gcc.NewSendSideBWE(options...)
+	})
+	if err != nil {
+		return err
+	}
+	factory.OnNewPeerConnection(func(id string, estimator cc.BandwidthEstimator) {
+		// Drop the estimator of a PeerConnection that failed to be created
+		select {
+		case <-c.estimators:
+		default:
+		}
+		c.estimators <- estimator
+	})
+	ir.Add(factory)
+	return webrtc.ConfigureTWCCHeaderExtensionSender(m, ir)
+}
+
+// attach returns the tracks to send to one peer: tracks, with the video
+// tracks we encode ourselves wrapped so their encoders follow the estimate
+// of the PeerConnection that was created last. It must be called right
+// after creating that PeerConnection.
+func (c *CongestionController) attach(logger *slog.Logger, tracks []webrtc.TrackLocal) []webrtc.TrackLocal {
+	var estimator cc.BandwidthEstimator
+	select {
+	case estimator = <-c.estimators:
+	default:
+		logger.Warn("No bandwidth estimator for PeerConnection, sending at a fixed bitrate")
+		return tracks
+	}
+
+	var adaptive []*adaptiveTrack
+	attached := make([]webrtc.TrackLocal, len(tracks))
+	for i, track := range tracks {
+		attached[i] = track
+		if vt, ok := track.(*mediadevices.VideoTrack); ok {
+			t := &adaptiveTrack{VideoTrack: vt}
+			adaptive = append(adaptive, t)
+			attached[i] = t
+		}
+	}
+	if len(adaptive) == 0 {
+		return tracks
+	}
+
+	var mu sync.Mutex
+	logged := 0
+	estimator.OnTargetBitrateChange(func(bitrate int) {
+		video := max(bitrate-c.audioBitrate, minVideoBitrate)
+		if c.maxVideoBitrate > 0 {
+			video = min(video, c.maxVideoBitrate)
+		}
+		for _, t := range adaptive {
+			t.SetBitRate(logger, video)
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		if math.Abs(float64(bitrate-logged)) >= estimateLogChange*float64(logged) {
+			logger.Info("Bandwidth estimate changed", "estimate_bps", bitrate, "video_bps", video)
+			logged = bitrate
+		} else {
+			logger.Debug("Bandwidth estimate", "estimate_bps", bitrate, "video_bps", video)
+		}
+	})
+	return attached
+}
+
+// Serialises binding adaptive tracks, so each one can tell which encoder
+// the shared VideoTrack created for it
+var adaptiveBindMu sync.Mutex
+
+// adaptiveTrack is a VideoTrack as sent to one peer, whose encoder bitrate
+// can be changed while it runs
+type adaptiveTrack struct {
+	*mediadevices.VideoTrack
+
+	mu         sync.Mutex
+	controller codec.BitRateController // Nil until bound, or if the encoder can't adapt
+	bitrate    int                     // Latest target, applied once bound
+}
+
+// Bind starts an encoder for the peer and remembers its controller
+func (t *adaptiveTrack) Bind(ctx webrtc.TrackLocalContext) (webrtc.RTPCodecParameters, error) {
+	adaptiveBindMu.Lock()
+	params, err := t.VideoTrack.Bind(ctx)
+	controller, _ := t.VideoTrack.EncoderController().(codec.BitRateController)
+	adaptiveBindMu.Unlock()
+	if err != nil {
+		return params, err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.controller = controller
+	if controller != nil && t.bitrate > 0 {
+		controller.SetBitRate(t.bitrate)
+	}
+	return params, nil
+}
+
+// SetBitRate sets the encoder's target bitrate in bits per second
+func (t *adaptiveTrack) SetBitRate(logger *slog.Logger, bitrate int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.bitrate = bitrate
+	if t.controller == nil {
+		return
+	}
+	if err := t.controller.SetBitRate(bitrate); err != nil {
+		logger.Warn("Failed to change video bitrate", "track_id", t.ID(), "err", err)
+	}
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4"
+)
+
+// How long a video frame missing packets is waited for before it is dropped,
+// in packets received after it and in time
+const (
+	jitterMaxLatePackets = 100
+	jitterMaxDelay       = 200 * time.Millisecond
+)
+
+// frameReader is a jitter buffer for one video track. It puts the packets it
+// reads back in order and hands them on a whole frame at a time, so sinks
+// never see a frame with packets missing. Frames are dropped until the first
+// keyframe, and after a frame that can't be completed up to the next one;
+// keyframes are asked for with keyframes while they are waited for.
+type frameReader struct {
+	logger       *slog.Logger
+	readPacket   func() (*rtp.Packet, error)
+	depacketizer rtp.Depacketizer
+	isKeyframe   func(frame []*rtp.Packet) bool
+	keyframes    *keyframeRequester
+
+	buffer  map[int64]*rtp.Packet // Buffered packets by extended sequence number
+	next    int64                 // Extended sequence number of the next packet to hand on
+	highest int64                 // Highest extended sequence number received
+	started bool
+
+	lastTimestamp int64 // RTP timestamp of the last frame handed on or dropped, -1 for none
+	stalledSince  time.Time
+	needKeyframe  bool // Drop frames until a keyframe
+
+	ready []*rtp.Packet // Packets of complete frames waiting to be read
+
+	// Packets read from the track, by a goroutine so that a stalled frame is
+	// given up on after jitterMaxDelay even if no more packets come
+	packets chan readResult
+
+	frames, dropped, late int
+}
+
+// readResult is what one call of readPacket returned
+type readResult struct {
+	pkt *rtp.Packet
+	err error
+}
+
+// newFrameReader returns a frameReader over the packets readPacket returns
+// for video encoded as mimeType, or nil if frames of mimeType can't be told
+// apart
+func newFrameReader(logger *slog.Logger, mimeType string, readPacket func() (*rtp.Packet, error), keyframes *keyframeRequester) *frameReader {
+	r := &frameReader{
+		logger:        logger,
+		readPacket:    readPacket,
+		keyframes:     keyframes,
+		buffer:        make(map[int64]*rtp.Packet),
+		lastTimestamp: -1,
+		needKeyframe:  true,
+	}
+	switch strings.ToLower(mimeType) {
+	case strings.ToLower(webrtc.MimeTypeVP8):
+		r.depacketizer, r.isKeyframe = &codecs.VP8Packet{}, isVP8RTPKeyframe
+	case strings.ToLower(webrtc.MimeTypeVP9):
+		r.depacketizer, r.isKeyframe = &codecs.VP9Packet{}, isVP9RTPKeyframe
+	case strings.ToLower(webrtc.MimeTypeH264):
+		r.depacketizer, r.isKeyframe = &codecs.H264Packet{}, isH264RTPKeyframe
+	case strings.ToLower(webrtc.MimeTypeAV1):
+		r.depacketizer, r.isKeyframe = &codecs.AV1Depacketizer{}, isAV1RTPKeyframe
+	default:
+		return nil
+	}
+	return r
+}
+
+// ReadRTP returns the next packet of a complete frame, in sequence order.
+// When reading fails, the frames still buffered are dropped.
+func (r *frameReader) ReadRTP() (*rtp.Packet, error) {
+	if r.packets == nil {
+		r.packets = make(chan readResult)
+		go r.readLoop()
+	}
+
+	for len(r.ready) == 0 {
+		// Wake up when the frame at the head has waited long enough
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !r.stalledSince.IsZero() {
+			timer = time.NewTimer(time.Until(r.stalledSince.Add(jitterMaxDelay)))
+			timeout = timer.C
+		}
+
+		var res readResult
+		select {
+		case res = <-r.packets:
+		case <-timeout:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if res.err != nil {
+			r.logger.Info("Stopped reassembling video frames", "frames", r.frames, "dropped", r.dropped, "late_packets", r.late)
+			return nil, res.err
+		}
+		if res.pkt != nil {
+			r.push(res.pkt)
+		}
+		r.release()
+	}
+	pkt := r.ready[0]
+	r.ready[0] = nil
+	r.ready = r.ready[1:]
+	return pkt, nil
+}
+
+// readLoop passes the packets readPacket returns to ReadRTP, up to the
+// first error
+func (r *frameReader) readLoop() {
+	for {
+		pkt, err := r.readPacket()
+		r.packets <- readResult{pkt, err}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// push buffers pkt, unless the frame it belongs to has already gone
+func (r *frameReader) push(pkt *rtp.Packet) {
+	seq := int64(pkt.SequenceNumber)
+	if r.started {
+		// Closest extended sequence number to the highest one so far
+		seq = r.highest + int64(int16(pkt.SequenceNumber-uint16(r.highest)))
+	} else {
+		r.next, r.highest, r.started = seq, seq, true
+		r.keyframes.Request("stream start")
+	}
+
+	if seq < r.next {
+		r.late++
+		return
+	}
+	r.buffer[seq] = pkt
+	r.highest = max(r.highest, seq)
+}
+
+// release moves complete frames at the head of the buffer to ready, and drops
+// the frame at the head when it has waited too long for its missing packets
+func (r *frameReader) release() {
+	for r.next <= r.highest {
+		frame, broken := r.headFrame()
+		if frame != nil {
+			for range frame {
+				delete(r.buffer, r.next)
+				r.next++
+			}
+			r.lastTimestamp = int64(frame[0].Timestamp)
+			r.stalledSince = time.Time{}
+			if r.needKeyframe && !r.isKeyframe(frame) {
+				r.dropped++
+				r.keyframes.Request("waiting for keyframe")
+				continue
+			}
+			if r.needKeyframe {
+				r.needKeyframe = false
+				r.keyframes.Received()
+			}
+			r.frames++
+			r.ready = append(r.ready, frame...)
+			continue
+		}
+
+		if !broken {
+			if r.stalledSince.IsZero() {
+				r.stalledSince = time.Now()
+			}
+			if r.highest-r.next < jitterMaxLatePackets && time.Since(r.stalledSince) < jitterMaxDelay {
+				return
+			}
+		}
+		r.dropHead()
+	}
+}
+
+// headFrame returns the packets of the frame at the head of the buffer if it
+// is complete. Otherwise broken reports whether it can never be completed,
+// because the packets that start it are gone.
+func (r *frameReader) headFrame() (frame []*rtp.Packet, broken bool) {
+	head := r.buffer[r.next]
+	if head == nil {
+		return nil, false
+	}
+	if !r.depacketizer.IsPartitionHead(head.Payload) || int64(head.Timestamp) == r.lastTimestamp {
+		return nil, true
+	}
+
+	for seq := r.next; ; seq++ {
+		pkt := r.buffer[seq]
+		switch {
+		case pkt == nil:
+			return nil, false
+		case pkt.Timestamp != head.Timestamp:
+			// The frame ended without a marker
+			return frame, false
+		}
+		frame = append(frame, pkt)
+		if r.depacketizer.IsPartitionTail(pkt.Marker, pkt.Payload) {
+			return frame, false
+		}
+	}
+}
+
+// dropHead drops the frame at the head of the buffer, and the packets after
+// it up to the next frame received, and asks for a keyframe. When the head
+// packets never came, the frame dropped is the one the first packet received
+// after them belongs to, unless that packet starts a frame: then the lost
+// packets were whole frames, and there is nothing else to drop.
+func (r *frameReader) dropHead() {
+	skipped := false
+	for r.buffer[r.next] == nil && r.next < r.highest {
+		r.next++
+		skipped = true
+	}
+	head := r.buffer[r.next]
+	if skipped && r.depacketizer.IsPartitionHead(head.Payload) && int64(head.Timestamp) != r.lastTimestamp {
+		r.dropLost()
+		return
+	}
+
+	r.lastTimestamp = int64(head.Timestamp)
+	delete(r.buffer, r.next)
+	r.next++
+	for r.next <= r.highest {
+		pkt := r.buffer[r.next]
+		if pkt != nil && int64(pkt.Timestamp) != r.lastTimestamp {
+			break
+		}
+		delete(r.buffer, r.next)
+		r.next++
+	}
+	r.dropLost()
+}
+
+// dropLost counts a frame as dropped and asks for a keyframe to recover
+func (r *frameReader) dropLost() {
+	r.stalledSince = time.Time{}
+	r.dropped++
+
+	r.needKeyframe = true
+	r.logger.Debug("Dropped incomplete video frame")
+	r.keyframes.Request("frame lost")
+}
+
+// isVP8RTPKeyframe reports whether frame is a VP8 keyframe
+func isVP8RTPKeyframe(frame []*rtp.Packet) bool {
+	var vp8 codecs.VP8Packet
+	payload, err := vp8.Unmarshal(frame[0].Payload)
+	return err == nil && vp8.S == 1 && vp8.PID == 0 && isVP8Keyframe(payload)
+}
+
+// isVP9RTPKeyframe reports whether frame is a VP9 keyframe
+func isVP9RTPKeyframe(frame []*rtp.Packet) bool {
+	var vp9 codecs.VP9Packet
+	_, err := vp9.Unmarshal(frame[0].Payload)
+	return err == nil && vp9.B && !vp9.P
+}
+
+// isH264RTPKeyframe reports whether frame holds an H.264 IDR slice or a
+// sequence parameter set, which encoders send just before one
+func isH264RTPKeyframe(frame []*rtp.Packet) bool {
+	const (
+		naluIDR  = 5
+		naluSPS  = 7
+		naluSTAP = 24
+		naluFUA  = 28
+	)
+	for _, pkt := range frame {
+		payload := pkt.Payload
+		if len(payload) < 2 {
+			continue
+		}
+		switch payload[0] & 0x1f {
+		case naluIDR, naluSPS:
+			return true
+		case naluFUA:
+			if payload[1]&0x1f == naluIDR {
+				return true
+			}
+		case naluSTAP:
+			// Each aggregated NAL unit is preceded by its 16-bit size
+			for i := 1; i+2 < len(payload); {
+				size := int(payload[i])<<8 | int(payload[i+1])
+				if t := payload[i+2] & 0x1f; t == naluIDR || t == naluSPS {
+					return true
+				}
+				i += 2 + size
+			}
+		}
+	}
+	return false
+}
+
+// isAV1RTPKeyframe reports whether frame starts a new AV1 coded video sequence
+func isAV1RTPKeyframe(frame []*rtp.Packet) bool {
+	const av1NMask = 0x08
+	payload := frame[0].Payload
+	return len(payload) > 0 && payload[0]&av1NMask != 0
+}
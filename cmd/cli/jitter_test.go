@@ -0,0 +1,325 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+var discardLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// newTestFrameReader returns a frameReader fed by calling push and release,
+// and a count of the keyframe requests it sends
+func newTestFrameReader(t *testing.T, mimeType string) (*frameReader, *atomic.Int32) {
+	t.Helper()
+	requests := new(atomic.Int32)
+	keyframes := &keyframeRequester{
+		logger: discardLogger,
+		writeRTCP: func([]rtcp.Packet) error {
+			requests.Add(1)
+			return nil
+		},
+	}
+	t.Cleanup(keyframes.Close)
+	r := newFrameReader(discardLogger, mimeType, nil, keyframes)
+	if r == nil {
+		t.Fatalf("No frameReader for %s", mimeType)
+	}
+	return r, requests
+}
+
+// testFrame describes a VP8 frame split into packets
+type testFrame struct {
+	key     bool
+	packets int
+}
+
+// vp8Packets packetizes frames, 3000 timestamp units apart, with sequence
+// numbers counting up from seq
+func vp8Packets(seq uint16, frames ...testFrame) []*rtp.Packet {
+	var pkts []*rtp.Packet
+	for i, f := range frames {
+		for j := range f.packets {
+			payload := []byte{0x00, 0xaa} // Continues the partition
+			if j == 0 {
+				payload = append([]byte{0x10}, vp8Frame(f.key, 320, 240)...)
+			}
+			pkts = append(pkts, &rtp.Packet{
+				Header: rtp.Header{
+					Version:        2,
+					Marker:         j == f.packets-1,
+					SequenceNumber: seq,
+					Timestamp:      uint32(i) * 3000,
+				},
+				Payload: payload,
+			})
+			seq++
+		}
+	}
+	return pkts
+}
+
+func TestFrameReader(t *testing.T) {
+	key := func(packets int) testFrame { return testFrame{key: true, packets: packets} }
+	inter := func(packets int) testFrame { return testFrame{packets: packets} }
+
+	for _, tt := range []struct {
+		name   string
+		start  uint16
+		frames []testFrame
+		order  []int // Indices of the packets pushed, all in order if nil
+		stall  bool  // Give up on missing packets after pushing
+		// Timestamps of the frames handed on, and the counters
+		want          []uint32
+		dropped, late int
+		next          int64 // Extended sequence number expected next, if set
+	}{
+		{
+			name:   "in order",
+			frames: []testFrame{key(2), inter(1), inter(2)},
+			want:   []uint32{0, 3000, 6000},
+		},
+		{
+			name:   "reordered",
+			frames: []testFrame{key(2), inter(1), inter(2)},
+			order:  []int{0, 3, 1, 4, 2},
+			want:   []uint32{0, 3000, 6000},
+		},
+		{
+			name:   "sequence number wraps",
+			start:  65534,
+			frames: []testFrame{key(2), inter(2), inter(1)},
+			order:  []int{0, 2, 1, 4, 3},
+			want:   []uint32{0, 3000, 6000},
+			next:   65534 + 5,
+		},
+		{
+			name:    "starts without a keyframe",
+			frames:  []testFrame{inter(1), key(1), inter(1)},
+			want:    []uint32{3000, 6000},
+			dropped: 1,
+		},
+		{
+			name:   "duplicate after its frame went",
+			frames: []testFrame{key(1), inter(1)},
+			order:  []int{0, 1, 0},
+			want:   []uint32{0, 3000},
+			late:   1,
+		},
+		{
+			name:   "late across the wrap",
+			start:  65535,
+			frames: []testFrame{key(1), inter(1), inter(1)},
+			order:  []int{0, 1, 2, 0},
+			want:   []uint32{0, 3000, 6000},
+			late:   1,
+			next:   65535 + 3,
+		},
+		{
+			name:   "missing packet is waited for",
+			frames: []testFrame{key(1), inter(2), key(1)},
+			order:  []int{0, 1, 3},
+			want:   []uint32{0},
+		},
+		{
+			name:    "missing packet times out",
+			frames:  []testFrame{key(1), inter(2), key(1)},
+			order:   []int{0, 1, 3},
+			stall:   true,
+			want:    []uint32{0, 6000},
+			dropped: 1,
+		},
+		{
+			name:    "dropped frame takes the inter frames after it",
+			frames:  []testFrame{key(1), inter(3), inter(1), key(1)},
+			order:   []int{0, 1, 3, 4, 5},
+			stall:   true,
+			want:    []uint32{0, 9000},
+			dropped: 2,
+		},
+		{
+			name:    "frame missing its start",
+			frames:  []testFrame{key(1), inter(2), key(1)},
+			order:   []int{0, 2, 3},
+			stall:   true,
+			want:    []uint32{0, 6000},
+			dropped: 1,
+		},
+		{
+			name:    "frame missing its start and the next one's",
+			frames:  []testFrame{key(1), inter(2), inter(2), key(1)},
+			order:   []int{0, 2, 4, 5},
+			stall:   true,
+			want:    []uint32{0, 9000},
+			dropped: 2,
+		},
+		{
+			name:    "whole frame lost before a keyframe",
+			frames:  []testFrame{key(1), inter(1), key(2)},
+			order:   []int{0, 2, 3},
+			stall:   true,
+			want:    []uint32{0, 6000},
+			dropped: 1,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r, requests := newTestFrameReader(t, webrtc.MimeTypeVP8)
+			pkts := vp8Packets(tt.start, tt.frames...)
+			order := tt.order
+			if order == nil {
+				for i := range pkts {
+					order = append(order, i)
+				}
+			}
+			for _, i := range order {
+				r.push(pkts[i])
+				r.release()
+			}
+			if tt.stall {
+				r.stalledSince = time.Now().Add(-jitterMaxDelay)
+				r.release()
+			}
+
+			var got []uint32
+			for i, pkt := range r.ready {
+				if i > 0 && pkt.SequenceNumber != r.ready[i-1].SequenceNumber+1 && pkt.Timestamp == r.ready[i-1].Timestamp {
+					t.Errorf("Packets of frame %d out of order", pkt.Timestamp)
+				}
+				if !slices.Contains(got, pkt.Timestamp) {
+					got = append(got, pkt.Timestamp)
+				}
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("Frames = %v, want %v", got, tt.want)
+			}
+			if r.dropped != tt.dropped || r.late != tt.late {
+				t.Errorf("Dropped %d and %d late packets, want %d and %d", r.dropped, r.late, tt.dropped, tt.late)
+			}
+			if tt.next != 0 && r.next != tt.next {
+				t.Errorf("Next sequence number = %d, want %d", r.next, tt.next)
+			}
+			if requests.Load() == 0 {
+				t.Error("No keyframe asked for at the start of the stream")
+			}
+		})
+	}
+}
+
+func TestFrameReaderGivesUpWhenPacketsStop(t *testing.T) {
+	pkts := vp8Packets(0, testFrame{key: true, packets: 1}, testFrame{packets: 2}, testFrame{key: true, packets: 1})
+	// The second packet of the inter frame is lost, and then nothing more
+	// arrives until the test ends
+	queue := make(chan *rtp.Packet, len(pkts))
+	for _, i := range []int{0, 1, 3} {
+		queue <- pkts[i]
+	}
+	done := make(chan struct{})
+	defer close(done)
+
+	r, _ := newTestFrameReader(t, webrtc.MimeTypeVP8)
+	r.readPacket = func() (*rtp.Packet, error) {
+		select {
+		case pkt := <-queue:
+			return pkt, nil
+		case <-done:
+			return nil, io.EOF
+		}
+	}
+
+	got := make(chan uint32)
+	go func() {
+		for {
+			pkt, err := r.ReadRTP()
+			if err != nil {
+				return
+			}
+			got <- pkt.Timestamp
+		}
+	}()
+
+	start := time.Now()
+	for _, want := range []uint32{0, 6000} {
+		select {
+		case ts := <-got:
+			if ts != want {
+				t.Fatalf("Got frame %d, want %d", ts, want)
+			}
+		case <-time.After(5 * jitterMaxDelay):
+			t.Fatalf("Frame %d still held %v after the stream stalled", want, 5*jitterMaxDelay)
+		}
+	}
+	if waited := time.Since(start); waited < jitterMaxDelay {
+		t.Errorf("Incomplete frame given up on after %v, want %v", waited, jitterMaxDelay)
+	}
+}
+
+func TestFrameReaderCancelsKeyframeRequestOnKeyframe(t *testing.T) {
+	r, _ := newTestFrameReader(t, webrtc.MimeTypeVP8)
+	pkts := vp8Packets(0, testFrame{packets: 1}, testFrame{key: true, packets: 1})
+
+	r.push(pkts[0])
+	r.release()
+	r.keyframes.mu.Lock()
+	pending := r.keyframes.pending != nil
+	r.keyframes.mu.Unlock()
+	if !pending {
+		t.Fatal("No keyframe request waiting behind the one sent at the start")
+	}
+
+	r.push(pkts[1])
+	r.release()
+	r.keyframes.mu.Lock()
+	defer r.keyframes.mu.Unlock()
+	if r.keyframes.pending != nil {
+		t.Error("Keyframe still asked for after one arrived")
+	}
+}
+
+func TestRTPKeyframeDetection(t *testing.T) {
+	packets := func(payloads ...[]byte) []*rtp.Packet {
+		var pkts []*rtp.Packet
+		for _, p := range payloads {
+			pkts = append(pkts, &rtp.Packet{Payload: p})
+		}
+		return pkts
+	}
+	for _, tt := range []struct {
+		name       string
+		isKeyframe func([]*rtp.Packet) bool
+		frame      []*rtp.Packet
+		want       bool
+	}{
+		{"VP8 keyframe", isVP8RTPKeyframe, packets(append([]byte{0x10}, vp8Frame(true, 320, 240)...)), true},
+		{"VP8 inter frame", isVP8RTPKeyframe, packets(append([]byte{0x10}, vp8Frame(false, 320, 240)...)), false},
+		{"VP8 keyframe continued", isVP8RTPKeyframe, packets(append([]byte{0x00}, vp8Frame(true, 320, 240)...)), false},
+		{"VP8 keyframe in partition 1", isVP8RTPKeyframe, packets(append([]byte{0x11}, vp8Frame(true, 320, 240)...)), false},
+
+		{"VP9 keyframe", isVP9RTPKeyframe, packets([]byte{0x08, 0xaa}), true},
+		{"VP9 inter frame", isVP9RTPKeyframe, packets([]byte{0x48, 0xaa}), false},
+		{"VP9 continued", isVP9RTPKeyframe, packets([]byte{0x00, 0xaa}), false},
+
+		{"H.264 IDR", isH264RTPKeyframe, packets([]byte{0x65, 0x88}), true},
+		{"H.264 SPS then IDR", isH264RTPKeyframe, packets([]byte{0x67, 0x42}, []byte{0x68, 0xce}, []byte{0x65, 0x88}), true},
+		{"H.264 non-IDR", isH264RTPKeyframe, packets([]byte{0x41, 0x9a}, []byte{0x41, 0x9b}), false},
+		{"H.264 STAP-A with SPS", isH264RTPKeyframe, packets([]byte{0x78, 0x00, 0x02, 0x09, 0x10, 0x00, 0x02, 0x67, 0x42}), true},
+		{"H.264 STAP-A without", isH264RTPKeyframe, packets([]byte{0x78, 0x00, 0x02, 0x09, 0x10, 0x00, 0x02, 0x41, 0x9a}), false},
+		{"H.264 FU-A of an IDR", isH264RTPKeyframe, packets([]byte{0x7c, 0x85, 0x88}, []byte{0x7c, 0x45, 0x88}), true},
+		{"H.264 FU-A of a non-IDR", isH264RTPKeyframe, packets([]byte{0x7c, 0x81, 0x9a}), false},
+		{"H.264 truncated", isH264RTPKeyframe, packets([]byte{0x65}), false},
+
+		{"AV1 new coded video sequence", isAV1RTPKeyframe, packets([]byte{0x18, 0xaa}), true},
+		{"AV1 continuing sequence", isAV1RTPKeyframe, packets([]byte{0x10, 0xaa}), false},
+		{"AV1 empty", isAV1RTPKeyframe, packets([]byte{}), false},
+	} {
+		if got := tt.isKeyframe(tt.frame); got != tt.want {
+			t.Errorf("%s: %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v4"
+)
+
+// Minimum time between two keyframe requests for the same track. Requests
+// made sooner are folded into one sent when the interval is up.
+const keyframeRequestInterval = time.Second
+
+// keyframeRequester asks the sender of a remote video track for a keyframe,
+// with a PLI or, if the sender only understands that, a FIR, at most once
+// per keyframeRequestInterval
+type keyframeRequester struct {
+	logger    *slog.Logger
+	writeRTCP func([]rtcp.Packet) error // Sends to the track's sender
+	ssrc      uint32
+	fir       bool // Send FIR rather than PLI
+
+	mu      sync.Mutex
+	last    time.Time   // When the last request was sent
+	pending *time.Timer // Request delayed by the rate limit, if any
+	firSeq  uint8
+	closed  bool
+}
+
+// newKeyframeRequester returns a requester for track, received on pc
+func newKeyframeRequester(logger *slog.Logger, pc *webrtc.PeerConnection, track *webrtc.TrackRemote) *keyframeRequester {
+	var pli, fir bool
+	for _, fb := range track.Codec().RTCPFeedback {
+		switch {
+		case fb.Type == webrtc.TypeRTCPFBNACK && fb.Parameter == "pli":
+			pli = true
+		case fb.Type == webrtc.TypeRTCPFBCCM && fb.Parameter == "fir":
+			fir = true
+		}
+	}
+	return &keyframeRequester{logger: logger, writeRTCP: pc.WriteRTCP, ssrc: uint32(track.SSRC()), fir: fir && !pli}
+}
+
+// Request asks for a keyframe now or, if one was asked for too recently, as
+// soon as the rate limit allows. reason is only logged.
+func (k *keyframeRequester) Request(reason string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.closed || k.pending != nil {
+		return
+	}
+
+	wait := keyframeRequestInterval - time.Since(k.last)
+	if wait <= 0 {
+		k.send(reason)
+		return
+	}
+	k.pending = time.AfterFunc(wait, func() {
+		k.mu.Lock()
+		defer k.mu.Unlock()
+		k.pending = nil
+		if !k.closed {
+			k.send(reason)
+		}
+	})
+}
+
+// send writes the request. k.mu must be held.
+func (k *keyframeRequester) send(reason string) {
+	k.last = time.Now()
+
+	kind := "PLI"
+	var pkt rtcp.Packet = &rtcp.PictureLossIndication{MediaSSRC: k.ssrc}
+	if k.fir {
+		k.firSeq++
+		kind = "FIR"
+		pkt = &rtcp.FullIntraRequest{MediaSSRC: k.ssrc, FIR: []rtcp.FIREntry{{SSRC: k.ssrc, SequenceNumber: k.firSeq}}}
+	}
+
+	k.logger.Debug("Requesting keyframe", "reason", reason, "type", kind)
+	if err := k.writeRTCP([]rtcp.Packet{pkt}); err != nil {
+		k.logger.Warn("Failed to request keyframe", "err", err)
+	}
+}
+
+// Received cancels a delayed request, once a keyframe has arrived
+func (k *keyframeRequester) Received() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.pending != nil {
+		k.pending.Stop()
+		k.pending = nil
+	}
+}
+
+// Close cancels any delayed request and stops new ones
+func (k *keyframeRequester) Close() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.closed = true
+	if k.pending != nil {
+		k.pending.Stop()
+		k.pending = nil
+	}
+}
@@ -4,32 +4,68 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
+	"net/url"
 	"os"
 	"os/exec"
 	"os/signal"
+	"slices"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 
-	"github.com/gorilla/websocket"
-	"github.com/pion/rtcp"
+	"clive/internal/logging"
+
 	"github.com/pion/rtp"
 	"github.com/pion/webrtc/v4"
-	"github.com/pion/webrtc/v4/pkg/media/ivfwriter"
 
 	"github.com/pion/mediadevices"
-	"github.com/pion/mediadevices/pkg/codec/opus"
-	"github.com/pion/mediadevices/pkg/codec/vpx"
 	_ "github.com/pion/mediadevices/pkg/driver/camera"
 	_ "github.com/pion/mediadevices/pkg/driver/microphone"
-	"github.com/pion/mediadevices/pkg/prop"
 )
 
 // Message matches the signaling server JSON structure
 type Message struct {
 	Type string          `json:"type"`
-	Data json.RawMessage `json:"data"`
+	From string          `json:"from,omitempty"`
+	To   string          `json:"to,omitempty"`
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+// SessionConfig is the payload of the "config" message the signaling server
+// sends right after connecting
+type SessionConfig struct {
+	ICEServers         []webrtc.ICEServer `json:"ice_servers"`
+	ICETransportPolicy string             `json:"ice_transport_policy,omitempty"`
+}
+
+// ErrorData is the payload of an "error" message
+type ErrorData struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Signaling error codes after which rejoining the room would only be
+// refused again, or would undo an administrator's decision or the room's
+// lifetime, so the client exits instead of reconnecting
+var fatalSignalingErrors = map[string]bool{
+	"room-full":    true,
+	"kicked":       true,
+	"room-closed":  true,
+	"room-expired": true,
+}
+
+// PeerInfo is the metadata the signaling server shares about a peer
+type PeerInfo struct {
+	ID       string    `json:"id"`
+	Name     string    `json:"name,omitempty"`
+	JoinedAt time.Time `json:"joined_at"`
+}
+
+// Roster is the payload of a "roster" message
+type Roster struct {
+	Peers []PeerInfo `json:"peers"`
 }
 
 // Track all spawned child processes so we can kill them on shutdown
@@ -38,10 +74,21 @@ var (
 	childProcsMu sync.Mutex
 )
 
+// trackChildProcess remembers cmd, which must have been started, until it
+// exits. Whoever kills it, it is waited for so it doesn't linger as a zombie.
 func trackChildProcess(cmd *exec.Cmd) {
 	childProcsMu.Lock()
-	defer childProcsMu.Unlock()
 	childProcs = append(childProcs, cmd)
+	childProcsMu.Unlock()
+
+	go func() {
+		cmd.Wait()
+		childProcsMu.Lock()
+		defer childProcsMu.Unlock()
+		if i := slices.Index(childProcs, cmd); i >= 0 {
+			childProcs = slices.Delete(childProcs, i, i+1)
+		}
+	}()
 }
 
 func killAllChildProcesses() {
@@ -55,345 +102,318 @@ func killAllChildProcesses() {
 	childProcs = nil
 }
 
-func spawnFFplayView(title string, getNextPacket func() (*rtp.Packet, error)) {
-	cmd := exec.Command("ffplay", "-i", "pipe:0", "-window_title", title, "-loglevel", "warning")
-	cmd.Stderr = os.Stderr // Pipe ffplay's stderr to our CLI so we can debug
-	stdin, err := cmd.StdinPipe()
-	if err != nil {
-		fmt.Println("Failed to create stdin pipe for ffplay:", err)
-		return
+func main() {
+	roomName := flag.String("room", "default-room", "The WebRTC room to join")
+	serverAddr := flag.String("server", "localhost:8080", "The signaling server host:port")
+	peerName := flag.String("name", defaultPeerName(), "Name shown to other peers in the room")
+	token := flag.String("token", os.Getenv("CLIVE_TOKEN"), "Access token for the signaling server (default $CLIVE_TOKEN)")
+	scheme := flag.String("scheme", "ws", "Signaling server URL scheme: ws or wss")
+	caCert := flag.String("ca-cert", "", "PEM file with additional CA certificates to trust for wss://")
+	insecureSkipVerify := flag.Bool("insecure-skip-verify", false, "Do not verify the signaling server's TLS certificate (testing only)")
+	pingInterval := flag.Duration("ping-interval", 20*time.Second, "How often to ping the signaling server")
+	pongTimeout := flag.Duration("pong-timeout", 60*time.Second, "Reconnect if the signaling server sends nothing for this long")
+	isCaller := flag.Bool("caller", false, "Whether this client is the caller (initiates an offer to every peer in the room)")
+	configPath := flag.String("config", "", "Path to a JSON config file (see README for the format)")
+	var iceServers iceServerFlag
+	flag.Var(&iceServers, "ice-server", "STUN/TURN server URL, e.g. stun:host:3478 or turn:user:pass@host:3478 (repeatable; overrides the config file)")
+	iceTransportPolicy := flag.String("ice-transport-policy", "", "ICE transport policy: all or relay (default all)")
+	videoSource := flag.String("video-source", SourceCamera, "Local video: camera, testpattern, none or file:<path.ivf>")
+	audioSource := flag.String("audio-source", SourceMic, "Local audio: mic, tone, none or file:<path.ogg>")
+	videoCodec := flag.String("video-codec", "vp8", "Preferred video codec: vp8, vp9, h264 or av1 (av1 needs a build with -tags av1); the others remain as fallbacks")
+	var settings MediaSettings
+	flag.IntVar(&settings.Width, "width", 0, "Video width in pixels; the camera must support it (default 640, or the closest the camera offers)")
+	flag.IntVar(&settings.Height, "height", 0, "Video height in pixels; the camera must support it (default 480, or the closest the camera offers)")
+	flag.Float64Var(&settings.FrameRate, "fps", 0, "Video frame rate; the camera must support it (default 30, or the closest the camera offers)")
+	flag.IntVar(&settings.VideoBitrate, "video-bitrate", 0, "Maximum video bitrate in bits per second; congestion control adapts below it, starting at the lower of this and 1 Mbps (default: no limit)")
+	flag.IntVar(&settings.KeyFrameInterval, "keyframe-interval", 0, "Maximum number of frames between keyframes (default: the encoder's)")
+	flag.IntVar(&settings.AudioBitrate, "audio-bitrate", 0, "Target Opus bitrate in bits per second, 6000 to 510000 (default: the encoder's)")
+	flag.DurationVar(&settings.OpusFrame, "opus-frame", 0, "Opus frame duration: 2.5ms, 5ms, 10ms, 20ms, 40ms or 60ms (default 20ms)")
+	flag.IntVar(&settings.AudioChannels, "audio-channels", 0, "Audio channels to capture and encode: 1 or 2 (default: the microphone's)")
+	display := flag.String("display", DisplayFFplay, "How to display video: ffplay (windows), file (IVF or H.264 files in the working directory) or none (headless)")
+	recordDir := flag.String("record-dir", "", "Save every remote track in this directory (IVF or H.264 for video, Ogg for Opus audio)")
+	recordWebM := flag.Bool("record-webm", false, "With -record-dir, also mux each peer's video and audio into one WebM file")
+	logFormat := flag.String("log-format", "text", "Log format: text or json")
+	logLevel := flag.String("log-level", "info", "Minimum log level: debug, info, warn or error")
+	flag.Parse()
+
+	if err := logging.Setup(*logFormat, *logLevel); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
 	}
-	if err := cmd.Start(); err != nil {
-		fmt.Println("Failed to start ffplay (is ffmpeg installed?):", err)
-		return
+
+	var fileConfig *FileConfig
+	if *configPath != "" {
+		var err error
+		if fileConfig, err = loadFileConfig(*configPath); err != nil {
+			logging.Fatal("Failed to load config", "err", err)
+		}
 	}
 
-	trackChildProcess(cmd)
+	slog.Info("Starting WebRTC CLI client", "room", *roomName, "server", *scheme+"://"+*serverAddr, "caller", *isCaller)
 
-	ivf, err := ivfwriter.NewWith(stdin)
+	// 1. WebRTC configuration shared by every peer connection
+	config, err := buildWebRTCConfig(fileConfig, iceServers, *iceTransportPolicy)
 	if err != nil {
-		fmt.Println("Failed to create IVF writer:", err)
-		return
+		logging.Fatal("Invalid ICE configuration", "err", err)
 	}
+	// ICE settings given locally win over the ones the signaling server
+	// advertises; the built-in STUN servers are the last resort
+	userICEServers := len(config.ICEServers) > 0
+	userICEPolicy := *iceTransportPolicy != "" || (fileConfig != nil && fileConfig.ICETransportPolicy != "")
+	if !userICEServers {
+		config.ICEServers = defaultICEServers
+	}
+	for _, server := range config.ICEServers {
+		slog.Info("ICE server", "urls", strings.Join(server.URLs, ", "))
+	}
+	slog.Info("ICE transport policy", "policy", config.ICETransportPolicy.String())
 
-	go func() {
-		defer stdin.Close()
-		defer ivf.Close()
-		defer cmd.Process.Kill()
-
-		frameCount := 0
-		for {
-			pkt, err := getNextPacket()
-			if err != nil {
-				fmt.Printf("[%s] Error reading packet: %v\n", title, err)
-				break
-			}
-
-			frameCount++
-			if frameCount == 1 {
-				fmt.Printf("[%s] Successfully received the FIRST RTP packet! Stream is flowing.\n", title)
-			} else if frameCount%150 == 0 {
-				fmt.Printf("[%s] Stream active: received %d packets so far...\n", title, frameCount)
-			}
-
-			if err := ivf.WriteRTP(pkt); err != nil {
-				fmt.Printf("[%s] Error writing RTP to IVF container: %v\n", title, err)
-				break
-			}
-		}
-		fmt.Printf("[%s] Video stream processing loop ended.\n", title)
-	}()
-}
-
-func main() {
-	roomName := flag.String("room", "default-room", "The WebRTC room to join")
-	serverAddr := flag.String("server", "localhost:8080", "The signaling server host:port")
-	isCaller := flag.Bool("caller", false, "Whether this client is the caller (initiates the offer)")
-	flag.Parse()
-
-	fmt.Printf("Starting WebRTC CLI Client...\n")
-	fmt.Printf("Room: %s\n", *roomName)
-	fmt.Printf("Signaling Server: %s\n", *serverAddr)
-	fmt.Printf("Caller Mode: %v\n", *isCaller)
-
-	// 1. Initialize WebRTC peer connection
-	config := webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{
-			{URLs: []string{"stun:stun.l.google.com:5349"}},
-			{URLs: []string{"stun:stun1.l.google.com:3478"}},
-			{URLs: []string{"stun:stun1.l.google.com:5349"}},
-			{URLs: []string{"stun:stun2.l.google.com:19302"}},
-			{URLs: []string{"stun:stun2.l.google.com:5349"}},
-			{URLs: []string{"stun:stun3.l.google.com:3478"}},
-			{URLs: []string{"stun:stun3.l.google.com:5349"}},
-			{URLs: []string{"stun:stun4.l.google.com:19302"}},
-			{URLs: []string{"stun:stun4.l.google.com:5349"}},
-		},
+	// 2. Setup WebSocket signaling; the connection is dialed in step 6
+	query := url.Values{"room": {*roomName}, "name": {*peerName}}
+	if *scheme != "ws" && *scheme != "wss" {
+		logging.Fatal("Invalid -scheme (want ws or wss)", "scheme", *scheme)
 	}
-	peerConnection, err := webrtc.NewPeerConnection(config)
+	tlsConfig, err := newTLSConfig(*caCert, *insecureSkipVerify)
 	if err != nil {
-		log.Fatalf("Failed to create PeerConnection: %v\n", err)
+		logging.Fatal("Failed to load CA certificate", "err", err)
+	}
+	if *insecureSkipVerify {
+		slog.Warn("TLS certificate verification is disabled")
 	}
-	defer peerConnection.Close()
+	wsURL := fmt.Sprintf("%s://%s/ws?%s", *scheme, *serverAddr, query.Encode())
+	signaling := NewSignalingClient(wsURL, *token, tlsConfig)
+	if *pingInterval <= 0 || *pongTimeout <= *pingInterval {
+		logging.Fatal("-ping-interval must be positive and shorter than -pong-timeout")
+	}
+	if *display != DisplayNone && *display != DisplayFFplay && *display != DisplayFile {
+		logging.Fatal("Invalid -display (want none, ffplay or file)", "display", *display)
+	}
+	if *recordWebM && *recordDir == "" {
+		logging.Fatal("-record-webm requires -record-dir")
+	}
+	if err := settings.Validate(); err != nil {
+		logging.Fatal("Invalid media settings", "err", err)
+	}
+	signaling.PingInterval = *pingInterval
+	signaling.PongTimeout = *pongTimeout
+	defer signaling.Close()
 
-	// Handle ICE Connection State changes
-	peerConnection.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
-		fmt.Printf("ICE Connection State changed: %s\n", state.String())
-	})
+	// 3. Open the local audio/video sources (optional)
+	codecSelector, err := newCodecSelector(*videoCodec, settings)
+	if err != nil {
+		logging.Fatal("Invalid -video-codec", "err", err)
+	}
+	congestion := NewCongestionController(settings)
+	api, err := newAPI(*videoCodec, congestion)
+	if err != nil {
+		logging.Fatal("Failed to set up WebRTC", "err", err)
+	}
 
-	// 2. Setup WebSocket signaling
-	wsURL := fmt.Sprintf("ws://%s/ws?room=%s", *serverAddr, *roomName)
-	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	localTracks, err := openLocalTracks(*videoSource, *audioSource, settings, codecSelector)
 	if err != nil {
-		log.Fatalf("Failed to connect to signaling server: %v", err)
+		logging.Fatal("Failed to open local media", "err", err)
 	}
-	defer conn.Close()
-	fmt.Println("Connected to Signaling Server.")
-
-	var writeMu sync.Mutex
-	writeJSON := func(msg Message) error {
-		writeMu.Lock()
-		defer writeMu.Unlock()
-		return conn.WriteJSON(msg)
+	if len(localTracks) == 0 {
+		slog.Warn("No local audio/video, continuing in receive-only mode")
 	}
 
-	// Send ICE candidates to the signaling server
-	peerConnection.OnICECandidate(func(candidate *webrtc.ICECandidate) {
-		if candidate == nil {
-			return
+	// 4. Local tracks are added to every PeerConnection
+	for _, track := range localTracks {
+		slog.Info("Added local track", "track_id", track.ID(), "kind", track.Kind().String())
+
+		if ft, ok := track.(*fileTrack); ok {
+			defer ft.Close()
+		}
+
+		if mt, ok := track.(mediadevices.Track); ok {
+			mt.OnEnded(func(err error) {
+				slog.Info("Track ended", "track_id", mt.ID(), "err", err)
+			})
+		}
+
+		// Show the local video feed too, unless running headless
+		vt, ok := track.(*mediadevices.VideoTrack)
+		if !ok || *display == DisplayNone {
+			continue
 		}
-		data, err := json.Marshal(candidate.ToJSON())
+		previewCodec := videoCodecs[*videoCodec].MimeType
+		reader, err := vt.NewRTPReader(previewCodec, 1234, 1200)
 		if err != nil {
-			log.Println("Failed to marshal candidate:", err)
-			return
+			continue
 		}
-		msg := Message{Type: "candidate", Data: data}
-		if err := writeJSON(msg); err != nil {
-			log.Println("Failed to send candidate:", err)
+		view, err := openDisplay(*display, "Local Video", previewCodec)
+		if err != nil {
+			slog.Error("Failed to open local preview", "display", *display, "err", err)
+			continue
 		}
-	})
-
-	// 3. Initialize mediadevices to capture local audio/video feeds (optional)
-	fmt.Println("Requesting camera and microphone access...")
-	vpxParams, _ := vpx.NewVP8Params()
-	opusParams, _ := opus.NewParams()
-
-	codecSelector := mediadevices.NewCodecSelector(
-		mediadevices.WithVideoEncoders(&vpxParams),
-		mediadevices.WithAudioEncoders(&opusParams),
-	)
-
-	mediaStream, err := mediadevices.GetUserMedia(mediadevices.MediaStreamConstraints{
-		Video: func(c *mediadevices.MediaTrackConstraints) {
-			c.Width = prop.Int(640)
-			c.Height = prop.Int(480)
-			c.FrameRate = prop.Float(30)
-		},
-		Codec: codecSelector,
-	})
-	if err != nil {
-		fmt.Printf("Warning: Failed to get user media: %v\n", err)
-		fmt.Println("Continuing without local audio/video (receive-only mode)")
-	} else {
-		// 4. Add local tracks to PeerConnection
-		for _, track := range mediaStream.GetTracks() {
-			track.OnEnded(func(err error) {
-				fmt.Printf("Track ended: %v\n", err)
-			})
 
-			_, err = peerConnection.AddTransceiverFromTrack(track,
-				webrtc.RTPTransceiverInit{
-					Direction: webrtc.RTPTransceiverDirectionSendrecv,
-				},
-			)
-			if err != nil {
-				log.Fatalf("Failed to add track: %v\n", err)
-			}
-			fmt.Printf("Added local track: %s\n", track.Kind().String())
-
-			// Capture and show local video feed using ffplay
-			if track.Kind() == webrtc.RTPCodecTypeVideo {
-				if vt, ok := track.(*mediadevices.VideoTrack); ok {
-					reader, err := vt.NewRTPReader(webrtc.MimeTypeVP8, 1234, 1200)
-					if err == nil {
-						var packetBuffer []*rtp.Packet
-						var release func()
-
-						spawnFFplayView("Local Video", func() (*rtp.Packet, error) {
-							if len(packetBuffer) == 0 {
-								if release != nil {
-									release()
-								}
-								pkts, rel, readErr := reader.Read()
-								if readErr != nil {
-									return nil, readErr
-								}
-								packetBuffer = pkts
-								release = rel
-							}
-							pkt := packetBuffer[0]
-							packetBuffer = packetBuffer[1:]
-							return pkt, nil
-						})
-					}
+		var packetBuffer []*rtp.Packet
+		var release func()
+		go pumpRTP(slog.With("track_id", vt.ID()), func() (*rtp.Packet, error) {
+			if len(packetBuffer) == 0 {
+				if release != nil {
+					release()
+				}
+				pkts, rel, readErr := reader.Read()
+				if readErr != nil {
+					return nil, readErr
 				}
+				packetBuffer = pkts
+				release = rel
 			}
-		}
+			pkt := packetBuffer[0]
+			packetBuffer = packetBuffer[1:]
+			return pkt, nil
+		}, view)
 	}
 
-	// 5. Handle remote tracks
-	peerConnection.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
-		fmt.Printf("Received remote track! ID: %s, Kind: %s\n", track.ID(), track.Kind().String())
-
-		if track.Kind() == webrtc.RTPCodecTypeVideo {
-			fmt.Println("Spawning window for remote video feed...")
-
-			// Request a keyframe (PLI) periodically to ensure ffplay starts decoding
-			go func() {
-				ticker := time.NewTicker(time.Second * 3)
-				for range ticker.C {
-					fmt.Printf("[Remote Video] Requesting Keyframe (PLI) for SSRC %d...\n", track.SSRC())
-					if rtcpErr := peerConnection.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: uint32(track.SSRC())}}); rtcpErr != nil {
-						fmt.Printf("[Remote Video] Failed to send PLI: %v\n", rtcpErr)
-						return
-					}
-				}
-			}()
-
-			spawnFFplayView("Remote Video", func() (*rtp.Packet, error) {
-				pkt, _, readErr := track.ReadRTP()
-				return pkt, readErr
-			})
+	// 5. One PeerConnection per remote peer, created on demand
+	mesh := NewMesh(api, config, localTracks, signaling.Send)
+	mesh.Display = *display
+	mesh.Congestion = congestion
+	if *recordDir != "" {
+		recorder, err := NewRecorder(*recordDir, *roomName, *recordWebM)
+		if err != nil {
+			logging.Fatal("Failed to set up recording", "err", err)
+		}
+		mesh.Recorder = recorder
+	}
+	defer mesh.CloseAll()
+
+	// A caller sends an offer to every peer as soon as it learns about it
+	onPeerReady := func(info PeerInfo) {
+		if *isCaller {
+			slog.Info("Peer is ready, creating offer", "peer_id", info.ID, "name", info.Name)
+			if err := mesh.Offer(info.ID); err != nil {
+				slog.Error("Failed to send offer", "peer_id", info.ID, "err", err)
+			}
 		} else {
-			// Basic track handling to keep the connection alive
-			go func() {
-				for {
-					_, _, readErr := track.ReadRTP()
-					if readErr != nil {
-						fmt.Printf("Failed to read from remote track: %v\n", readErr)
-						return
-					}
-				}
-			}()
+			slog.Info("Peer is ready, waiting for offer", "peer_id", info.ID, "name", info.Name)
 		}
-	})
+	}
 
-	// 6. Signaling Loop
-	hasInitiated := false
-	var pendingCandidates []webrtc.ICECandidateInit
+	// 6. Signaling Loop. After a reconnect the server has assigned us a new
+	// peer ID and the other peers have already dropped their connections to
+	// us, so start over from the roster that follows.
+	onConnect := func(reconnect bool) {
+		if reconnect {
+			slog.Info("Rejoined the room, renegotiating with all peers", "room", *roomName)
+			mesh.CloseAll()
+		}
+	}
 
-	go func() {
-		for {
-			var msg Message
-			if err := conn.ReadJSON(&msg); err != nil {
-				log.Println("WebSocket read error:", err)
-				break
+	go signaling.Run(onConnect, func(msg Message) {
+		switch msg.Type {
+		case "config":
+			var session SessionConfig
+			if err := json.Unmarshal(msg.Data, &session); err != nil {
+				slog.Warn("Failed to parse config", "err", err)
+				return
 			}
-
-			switch msg.Type {
-			case "peer-ready":
-				if *isCaller {
-					if !hasInitiated {
-						fmt.Println("Peer is ready. Initiating call (creating offer)...")
-						hasInitiated = true
-						offer, err := peerConnection.CreateOffer(nil)
-						if err != nil {
-							log.Printf("Failed to create offer: %v\n", err)
-							continue
-						}
-						if err := peerConnection.SetLocalDescription(offer); err != nil {
-							log.Printf("Failed to set local description: %v\n", err)
-							continue
-						}
-						offerData, _ := json.Marshal(offer)
-						writeJSON(Message{Type: "offer", Data: offerData})
-					}
-				} else {
-					fmt.Println("Peer is ready. Waiting for offer...")
+			servers, policy := config.ICEServers, config.ICETransportPolicy
+			if !userICEServers && len(session.ICEServers) > 0 {
+				servers = session.ICEServers
+				for _, server := range servers {
+					slog.Info("ICE server from signaling", "urls", strings.Join(server.URLs, ", "))
 				}
-
-			case "offer":
-				fmt.Println("Received offer, setting remote description")
-				var offer webrtc.SessionDescription
-				if err := json.Unmarshal(msg.Data, &offer); err != nil {
-					log.Println("Failed to parse offer:", err)
-					continue
-				}
-
-				if err := peerConnection.SetRemoteDescription(offer); err != nil {
-					log.Println("Failed to set remote description:", err)
-					continue
+			}
+			if !userICEPolicy && session.ICETransportPolicy != "" {
+				var err error
+				if policy, err = parseICETransportPolicy(session.ICETransportPolicy); err != nil {
+					slog.Warn("Ignoring ICE transport policy from signaling", "err", err)
+					policy = config.ICETransportPolicy
+				} else {
+					slog.Info("ICE transport policy from signaling", "policy", policy.String())
 				}
+			}
+			if policy == webrtc.ICETransportPolicyRelay && !hasTURNServer(servers) {
+				slog.Warn("Relay-only ICE policy but no TURN server configured or advertised")
+			}
+			mesh.SetICE(servers, policy)
 
-				// Apply any queued candidates
-				for _, c := range pendingCandidates {
-					if err := peerConnection.AddICECandidate(c); err != nil {
-						log.Println("Failed to add queued ICE candidate:", err)
-					}
-				}
-				pendingCandidates = nil
+		case "welcome":
+			slog.Info("Joined room", "room", *roomName, "peer_id", msg.To)
+			mesh.SetSelfID(msg.To)
 
-				fmt.Println("Creating answer...")
-				answer, err := peerConnection.CreateAnswer(nil)
-				if err != nil {
-					log.Println("Failed to create answer:", err)
-					continue
-				}
-				if err := peerConnection.SetLocalDescription(answer); err != nil {
-					log.Println("Failed to set local description:", err)
-					continue
-				}
+		case "roster":
+			var roster Roster
+			if err := json.Unmarshal(msg.Data, &roster); err != nil {
+				slog.Warn("Failed to parse roster", "err", err)
+				return
+			}
+			slog.Info("Received roster", "room", *roomName, "peers", len(roster.Peers))
+			for _, info := range roster.Peers {
+				onPeerReady(info)
+			}
 
-				ansData, _ := json.Marshal(answer)
-				writeJSON(Message{Type: "answer", Data: ansData})
-				fmt.Println("Answer sent.")
+		case "peer-joined":
+			var info PeerInfo
+			if err := json.Unmarshal(msg.Data, &info); err != nil {
+				slog.Warn("Failed to parse peer-joined", "err", err)
+				return
+			}
+			onPeerReady(info)
 
-			case "answer":
-				fmt.Println("Received answer, setting remote description")
-				var answer webrtc.SessionDescription
-				if err := json.Unmarshal(msg.Data, &answer); err != nil {
-					log.Println("Failed to parse answer:", err)
-					continue
-				}
+		case "peer-left":
+			slog.Info("Peer left the room", "room", *roomName, "peer_id", msg.From)
+			mesh.Remove(msg.From)
 
-				if err := peerConnection.SetRemoteDescription(answer); err != nil {
-					log.Println("Failed to set remote description:", err)
-					continue
-				}
+		case "offer":
+			slog.Info("Received offer", "peer_id", msg.From)
+			if err := mesh.HandleOffer(msg); err != nil {
+				slog.Error("Failed to handle offer", "peer_id", msg.From, "err", err)
+			}
 
-				// Apply any queued candidates
-				for _, c := range pendingCandidates {
-					if err := peerConnection.AddICECandidate(c); err != nil {
-						log.Println("Failed to add queued ICE candidate:", err)
-					}
-				}
-				pendingCandidates = nil
+		case "answer":
+			slog.Info("Received answer", "peer_id", msg.From)
+			if err := mesh.HandleAnswer(msg); err != nil {
+				slog.Error("Failed to handle answer", "peer_id", msg.From, "err", err)
+			}
 
-			case "candidate":
-				var candidate webrtc.ICECandidateInit
-				if err := json.Unmarshal(msg.Data, &candidate); err != nil {
-					log.Println("Failed to parse candidate:", err)
-					continue
-				}
+		case "candidate":
+			if err := mesh.HandleCandidate(msg); err != nil {
+				slog.Warn("Failed to handle candidate", "peer_id", msg.From, "err", err)
+			}
 
-				if peerConnection.RemoteDescription() == nil {
-					// Queue candidate if remote description is not set yet
-					pendingCandidates = append(pendingCandidates, candidate)
-				} else {
-					if err := peerConnection.AddICECandidate(candidate); err != nil {
-						log.Println("Failed to add ICE candidate:", err)
-					}
-				}
+		case "error":
+			var errData ErrorData
+			if err := json.Unmarshal(msg.Data, &errData); err != nil {
+				slog.Warn("Failed to parse error", "err", err)
+				return
+			}
+			slog.Error("Signaling server error", "code", errData.Code, "message", errData.Message)
+			if fatalSignalingErrors[errData.Code] {
+				slog.Error("Leaving without rejoining the room", "room", *roomName, "code", errData.Code)
+				signaling.Stop()
 			}
 		}
-	}()
+	})
 
-	fmt.Println("WebRTC Client is running. Waiting for peers...")
+	slog.Info("WebRTC client is running, waiting for peers")
 
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	<-sigChan
+	exitCode := 0
+	select {
+	case <-sigChan:
+		slog.Info("Shutting down")
+	case <-signaling.Stopped():
+		exitCode = 1
+	}
 
-	fmt.Println("Shutting down...")
 	killAllChildProcesses()
+	if exitCode != 0 {
+		mesh.CloseAll()
+		os.Exit(exitCode)
+	}
+}
+
+// defaultPeerName returns the hostname, which is usually enough to tell
+// devices apart in a room
+func defaultPeerName() string {
+	name, err := os.Hostname()
+	if err != nil {
+		return ""
+	}
+	return name
 }
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"slices"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4/pkg/media"
+)
+
+// Ways of displaying video, selected with -display
+const (
+	DisplayNone   = "none"   // Don't display video (headless)
+	DisplayFFplay = "ffplay" // Show each stream in an ffplay window
+	DisplayFile   = "file"   // Write each stream to a file named after its title
+)
+
+// openDisplay returns a sink that displays the video stream titled title,
+// encoded as mimeType, as mode asks, or nil if video is not displayed
+func openDisplay(mode, title, mimeType string) (media.Writer, error) {
+	switch mode {
+	case DisplayFFplay:
+		view, err := spawnFFplayView(title, mimeType)
+		if err != nil {
+			return nil, err
+		}
+		return view, nil
+	case DisplayFile:
+		f, err := os.Create(sanitizeFileName(title) + videoFileExt(mimeType))
+		if err != nil {
+			return nil, err
+		}
+		w, err := newVideoWriter(f, mimeType)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return w, nil
+	default:
+		return nil, nil
+	}
+}
+
+// ffplayView is an ffplay window playing a video stream it is fed as IVF,
+// or as an H.264 byte stream
+type ffplayView struct {
+	cmd    *exec.Cmd
+	stream media.Writer
+}
+
+// spawnFFplayView starts an ffplay window titled title for video encoded as
+// mimeType
+func spawnFFplayView(title, mimeType string) (*ffplayView, error) {
+	cmd := exec.Command("ffplay", "-i", "pipe:0", "-window_title", title, "-loglevel", "warning")
+	cmd.Stderr = &logWriter{logger: slog.With("window", title)}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create stdin pipe for ffplay: %w", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start ffplay (is ffmpeg installed?): %w", err)
+	}
+
+	trackChildProcess(cmd)
+
+	stream, err := newVideoWriter(stdin, mimeType)
+	if err != nil {
+		cmd.Process.Kill()
+		return nil, fmt.Errorf("failed to create video writer: %w", err)
+	}
+	return &ffplayView{cmd: cmd, stream: stream}, nil
+}
+
+// logWriter logs each line a child process writes to it, so its output ends
+// up in our log, in the format picked with -log-format
+type logWriter struct {
+	logger *slog.Logger
+	line   []byte // Start of a line whose end hasn't been written yet
+}
+
+// Longest line kept whole; longer ones are logged in pieces
+const maxLogLineLength = 4096
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	w.line = append(w.line, p...)
+	for {
+		// ffplay ends status lines with a carriage return
+		i := bytes.IndexAny(w.line, "\r\n")
+		if i < 0 {
+			if len(w.line) < maxLogLineLength {
+				break
+			}
+			i = len(w.line)
+		}
+		if line := bytes.TrimSpace(w.line[:i]); len(line) > 0 {
+			w.logger.Warn("ffplay", "output", string(line))
+		}
+		w.line = w.line[min(i+1, len(w.line)):]
+	}
+	return len(p), nil
+}
+
+// WriteRTP depacketizes pkt into the window's video stream
+func (v *ffplayView) WriteRTP(pkt *rtp.Packet) error {
+	return v.stream.WriteRTP(pkt)
+}
+
+// Close ends the stream and closes the window
+func (v *ffplayView) Close() error {
+	v.stream.Close() // Also closes ffplay's stdin
+	return v.cmd.Process.Kill()
+}
+
+// pumpRTP reads packets with readPacket until it fails and copies each one
+// to every sink. A sink that fails is closed and dropped without interrupting
+// the others; the rest are closed when reading stops.
+func pumpRTP(logger *slog.Logger, readPacket func() (*rtp.Packet, error), sinks ...media.Writer) {
+	defer func() {
+		for _, sink := range sinks {
+			sink.Close()
+		}
+	}()
+
+	packets := 0
+	for {
+		pkt, err := readPacket()
+		if err != nil {
+			logger.Info("Stopped reading packets", "packets", packets, "err", err)
+			return
+		}
+
+		packets++
+		if packets == 1 {
+			logger.Info("Received first RTP packet, stream is flowing")
+		} else if packets%150 == 0 {
+			logger.Debug("Stream active", "packets", packets)
+		}
+
+		for i := 0; i < len(sinks); {
+			if err := sinks[i].WriteRTP(pkt); err != nil {
+				logger.Warn("Dropping media sink after write error", "err", err)
+				sinks[i].Close()
+				sinks = slices.Delete(sinks, i, i+1)
+				continue
+			}
+			i++
+		}
+	}
+}
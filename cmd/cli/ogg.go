@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"time"
+)
+
+var errNotOggPage = errors.New("not an Ogg page")
+
+// oggPacketReader reads the packets of an Ogg stream. Pages are split into
+// packets with their segment tables, and packets continued on the next page
+// are joined.
+type oggPacketReader struct {
+	r        io.Reader
+	segments []byte // Lacing values of the current page not read yet
+	payload  []byte // Rest of the current page's payload
+	partial  []byte // Start of a packet continued on the next page
+}
+
+func newOggPacketReader(r io.Reader) *oggPacketReader {
+	return &oggPacketReader{r: r}
+}
+
+// ReadPacket returns the next packet. It fails with io.EOF at the end of the
+// stream.
+func (o *oggPacketReader) ReadPacket() ([]byte, error) {
+	for {
+		for i, lacing := range o.segments {
+			o.partial = append(o.partial, o.payload[:lacing]...)
+			o.payload = o.payload[lacing:]
+			// A lacing value below 255 ends the packet
+			if lacing < 255 {
+				o.segments = o.segments[i+1:]
+				packet := o.partial
+				o.partial = nil
+				return packet, nil
+			}
+		}
+		o.segments = nil
+		if err := o.readPage(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// readPage reads the next page's segment table and payload
+func (o *oggPacketReader) readPage() error {
+	var header [27]byte
+	if _, err := io.ReadFull(o.r, header[:]); err != nil {
+		return err
+	}
+	if !bytes.Equal(header[:4], []byte("OggS")) {
+		return errNotOggPage
+	}
+	if header[5]&0x01 == 0 {
+		o.partial = nil // Not a continuation, so the last page was cut short
+	}
+
+	o.segments = make([]byte, header[26])
+	if _, err := io.ReadFull(o.r, o.segments); err != nil {
+		return err
+	}
+	size := 0
+	for _, lacing := range o.segments {
+		size += int(lacing)
+	}
+	o.payload = make([]byte, size)
+	_, err := io.ReadFull(o.r, o.payload)
+	return err
+}
+
+// opusPacketDuration returns how much audio an Opus packet holds, from its
+// TOC byte (RFC 6716, section 3.1), or 0 if it is malformed
+func opusPacketDuration(packet []byte) time.Duration {
+	if len(packet) == 0 {
+		return 0
+	}
+	toc := packet[0]
+	config := toc >> 3
+
+	var frame time.Duration
+	switch {
+	case config < 12: // SILK
+		frame = []time.Duration{10, 20, 40, 60}[config%4] * time.Millisecond
+	case config < 16: // Hybrid
+		frame = []time.Duration{10, 20}[config%2] * time.Millisecond
+	default: // CELT
+		frame = []time.Duration{2500, 5000, 10000, 20000}[config%4] * time.Microsecond
+	}
+
+	switch toc & 0x03 {
+	case 0:
+		return frame
+	case 1, 2:
+		return 2 * frame
+	default:
+		if len(packet) < 2 {
+			return 0
+		}
+		return time.Duration(packet[1]&0x3f) * frame
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+// oggPage returns a page holding payload laced as lacing
+func oggPage(continued bool, lacing []byte, payload []byte) []byte {
+	header := make([]byte, 27)
+	copy(header, "OggS")
+	if continued {
+		header[5] = 0x01
+	}
+	header[26] = byte(len(lacing))
+	page := append(header, lacing...)
+	return append(page, payload...)
+}
+
+func TestOggPacketReader(t *testing.T) {
+	long := bytes.Repeat([]byte{0xab}, 300)
+	spanning := bytes.Repeat([]byte{0xcd}, 255+10)
+
+	var stream []byte
+	// Two packets on one page, the second longer than one segment
+	stream = append(stream, oggPage(false, []byte{3, 255, 45}, append([]byte{1, 2, 3}, long...))...)
+	// A packet continued on the next page, which ends with a short one
+	stream = append(stream, oggPage(false, []byte{255}, spanning[:255])...)
+	stream = append(stream, oggPage(true, []byte{10, 2}, append(spanning[255:], 7, 8))...)
+
+	want := [][]byte{{1, 2, 3}, long, spanning, {7, 8}}
+	r := newOggPacketReader(bytes.NewReader(stream))
+	for i, w := range want {
+		packet, err := r.ReadPacket()
+		if err != nil {
+			t.Fatalf("Packet %d: %v", i, err)
+		}
+		if !bytes.Equal(packet, w) {
+			t.Errorf("Packet %d = %x, want %x", i, packet, w)
+		}
+	}
+	if _, err := r.ReadPacket(); !errors.Is(err, io.EOF) {
+		t.Errorf("After the last packet: %v, want EOF", err)
+	}
+}
+
+func TestOpusPacketDuration(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		packet []byte
+		want   time.Duration
+	}{
+		{"SILK 20 ms", []byte{1 << 3}, 20 * time.Millisecond},
+		{"SILK 60 ms", []byte{3 << 3}, 60 * time.Millisecond},
+		{"hybrid 10 ms", []byte{12 << 3}, 10 * time.Millisecond},
+		{"CELT 2.5 ms", []byte{16 << 3}, 2500 * time.Microsecond},
+		{"CELT 20 ms", []byte{31 << 3}, 20 * time.Millisecond},
+		{"two equal frames", []byte{31<<3 | 1}, 40 * time.Millisecond},
+		{"two different frames", []byte{31<<3 | 2}, 40 * time.Millisecond},
+		{"three frames", []byte{31<<3 | 3, 3}, 60 * time.Millisecond},
+		{"frame count missing", []byte{31<<3 | 3}, 0},
+		{"empty", nil, 0},
+	} {
+		if got := opusPacketDuration(tt.packet); got != tt.want {
+			t.Errorf("%s: %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
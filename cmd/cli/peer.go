@@ -0,0 +1,380 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"sync"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+)
+
+// Peer is the PeerConnection negotiated with a single remote participant
+type Peer struct {
+	ID string
+	pc *webrtc.PeerConnection
+
+	// Candidates received before the remote description was set.
+	// Only touched from the signaling loop.
+	pendingCandidates []webrtc.ICECandidateInit
+
+	// ffplay windows showing this peer's video tracks
+	viewsMu sync.Mutex
+	views   []*exec.Cmd
+}
+
+// Mesh maintains one Peer per remote participant in the room and negotiates
+// each of them independently
+type Mesh struct {
+	api         *webrtc.API
+	config      webrtc.Configuration
+	localTracks []webrtc.TrackLocal
+	send        func(Message) error
+
+	// How remote video is displayed, one of the Display* modes
+	Display string
+	// Saves remote tracks when set
+	Recorder *Recorder
+	// Adapts outgoing video to each peer's bandwidth when set; must be the
+	// one the API was built with
+	Congestion *CongestionController
+
+	mu     sync.Mutex
+	selfID string
+	peers  map[string]*Peer
+}
+
+// NewMesh creates an empty mesh that creates PeerConnections with api, shares
+// localTracks with every peer and uses send to deliver signaling messages.
+func NewMesh(api *webrtc.API, config webrtc.Configuration, localTracks []webrtc.TrackLocal, send func(Message) error) *Mesh {
+	return &Mesh{
+		api:         api,
+		config:      config,
+		localTracks: localTracks,
+		send:        send,
+		Display:     DisplayFFplay,
+		peers:       make(map[string]*Peer),
+	}
+}
+
+// SetSelfID records the peer ID the signaling server assigned to us
+func (m *Mesh) SetSelfID(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.selfID = id
+}
+
+// SetICE replaces the ICE servers and transport policy used for
+// PeerConnections created from now on
+func (m *Mesh) SetICE(servers []webrtc.ICEServer, policy webrtc.ICETransportPolicy) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.config.ICEServers = servers
+	m.config.ICETransportPolicy = policy
+}
+
+func (m *Mesh) getSelfID() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.selfID
+}
+
+// peer returns the Peer for id, creating its PeerConnection on first use
+func (m *Mesh) peer(id string) (*Peer, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if p, ok := m.peers[id]; ok {
+		return p, nil
+	}
+
+	pc, err := m.api.NewPeerConnection(m.config)
+	if err != nil {
+		return nil, err
+	}
+	p := &Peer{ID: id, pc: pc}
+
+	// Handle ICE Connection State changes, restarting ICE when the
+	// connection fails (e.g. after a network change). Only the peer with the
+	// lower ID restarts, so both sides never restart the same connection at
+	// once, whether or not they are callers.
+	pc.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
+		slog.Info("ICE connection state changed", "peer_id", id, "state", state.String())
+		if state == webrtc.ICEConnectionStateFailed && m.getSelfID() < id {
+			go func() {
+				if err := m.restartICE(p); err != nil {
+					slog.Error("ICE restart failed", "peer_id", id, "err", err)
+				}
+			}()
+		}
+	})
+
+	// Send ICE candidates to this peer through the signaling server
+	pc.OnICECandidate(func(candidate *webrtc.ICECandidate) {
+		if candidate == nil {
+			return
+		}
+		data, err := json.Marshal(candidate.ToJSON())
+		if err != nil {
+			slog.Error("Failed to marshal candidate", "peer_id", id, "err", err)
+			return
+		}
+		if err := m.send(Message{Type: "candidate", To: id, Data: data}); err != nil {
+			slog.Warn("Failed to send candidate", "peer_id", id, "err", err)
+		}
+	})
+
+	tracks := m.localTracks
+	if m.Congestion != nil {
+		tracks = m.Congestion.attach(slog.With("peer_id", id), tracks)
+	}
+	for _, track := range tracks {
+		_, err := pc.AddTransceiverFromTrack(track,
+			webrtc.RTPTransceiverInit{
+				Direction: webrtc.RTPTransceiverDirectionSendrecv,
+			},
+		)
+		if err != nil {
+			pc.Close()
+			return nil, fmt.Errorf("failed to add %s track: %w", track.Kind(), err)
+		}
+	}
+
+	pc.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		m.handleRemoteTrack(p, track)
+	})
+
+	m.peers[id] = p
+	slog.Info("Created PeerConnection", "peer_id", id, "peers", len(m.peers))
+	return p, nil
+}
+
+// handleRemoteTrack starts consuming a track received from p, displaying
+// video and saving it if recording is enabled
+func (m *Mesh) handleRemoteTrack(p *Peer, track *webrtc.TrackRemote) {
+	logger := slog.With("peer_id", p.ID, "track_id", track.ID(), "ssrc", uint32(track.SSRC()))
+	logger.Info("Received remote track", "kind", track.Kind().String(), "codec", track.Codec().MimeType)
+
+	var sinks []media.Writer
+	if track.Kind() == webrtc.RTPCodecTypeVideo {
+		view, err := openDisplay(m.Display, fmt.Sprintf("Remote Video %s (%s)", p.ID, track.ID()), track.Codec().MimeType)
+		if err != nil {
+			logger.Error("Failed to open video display", "display", m.Display, "err", err)
+		} else if view != nil {
+			if ffplay, ok := view.(*ffplayView); ok {
+				p.viewsMu.Lock()
+				p.views = append(p.views, ffplay.cmd)
+				p.viewsMu.Unlock()
+			}
+			sinks = append(sinks, view)
+		}
+	}
+	if m.Recorder != nil {
+		sinks = append(sinks, m.Recorder.Sinks(p.ID, track, logger)...)
+	}
+
+	readPacket := func() (*rtp.Packet, error) {
+		pkt, _, err := track.ReadRTP()
+		return pkt, err
+	}
+	if track.Kind() != webrtc.RTPCodecTypeVideo || len(sinks) == 0 {
+		go pumpRTP(logger, readPacket, sinks...)
+		return
+	}
+
+	// Hand the sinks whole frames only. Keyframes are only asked for when
+	// they start decoding and when a frame is lost; NACKs recover the rest.
+	keyframes := newKeyframeRequester(logger, p.pc, track)
+	if frames := newFrameReader(logger, track.Codec().MimeType, readPacket, keyframes); frames != nil {
+		readPacket = frames.ReadRTP
+	} else {
+		keyframes.Request("stream start")
+	}
+	go func() {
+		pumpRTP(logger, readPacket, sinks...)
+		keyframes.Close()
+	}()
+}
+
+// Offer creates a PeerConnection for id and sends it an offer
+func (m *Mesh) Offer(id string) error {
+	p, err := m.peer(id)
+	if err != nil {
+		return err
+	}
+
+	offer, err := p.pc.CreateOffer(nil)
+	if err != nil {
+		return fmt.Errorf("failed to create offer: %w", err)
+	}
+	if err := p.pc.SetLocalDescription(offer); err != nil {
+		return fmt.Errorf("failed to set local description: %w", err)
+	}
+	offerData, _ := json.Marshal(offer)
+	return m.send(Message{Type: "offer", To: id, Data: offerData})
+}
+
+// restartICE sends p a new offer with fresh ICE credentials
+func (m *Mesh) restartICE(p *Peer) error {
+	m.mu.Lock()
+	current, ok := m.peers[p.ID]
+	m.mu.Unlock()
+	if !ok || current != p {
+		return nil // Peer left or was replaced in the meantime
+	}
+
+	slog.Info("Restarting ICE", "peer_id", p.ID)
+	offer, err := p.pc.CreateOffer(&webrtc.OfferOptions{ICERestart: true})
+	if err != nil {
+		return fmt.Errorf("failed to create offer: %w", err)
+	}
+	if err := p.pc.SetLocalDescription(offer); err != nil {
+		return fmt.Errorf("failed to set local description: %w", err)
+	}
+	offerData, _ := json.Marshal(offer)
+	return m.send(Message{Type: "offer", To: p.ID, Data: offerData})
+}
+
+// HandleOffer applies a remote offer and replies with an answer. When both
+// sides offered at once, the peer with the lower ID keeps its own offer and
+// the other one rolls back.
+func (m *Mesh) HandleOffer(msg Message) error {
+	var offer webrtc.SessionDescription
+	if err := json.Unmarshal(msg.Data, &offer); err != nil {
+		return fmt.Errorf("failed to parse offer: %w", err)
+	}
+
+	p, err := m.peer(msg.From)
+	if err != nil {
+		return err
+	}
+
+	if p.pc.SignalingState() == webrtc.SignalingStateHaveLocalOffer {
+		if m.getSelfID() < msg.From {
+			slog.Info("Offer collision, keeping our own offer", "peer_id", msg.From)
+			return nil
+		}
+		slog.Info("Offer collision, rolling back our offer", "peer_id", msg.From)
+		if err := p.pc.SetLocalDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeRollback}); err != nil {
+			return fmt.Errorf("failed to roll back local offer: %w", err)
+		}
+	}
+
+	if err := p.pc.SetRemoteDescription(offer); err != nil {
+		return fmt.Errorf("failed to set remote description: %w", err)
+	}
+	p.flushCandidates()
+
+	slog.Debug("Creating answer", "peer_id", msg.From)
+	answer, err := p.pc.CreateAnswer(nil)
+	if err != nil {
+		return fmt.Errorf("failed to create answer: %w", err)
+	}
+	if err := p.pc.SetLocalDescription(answer); err != nil {
+		return fmt.Errorf("failed to set local description: %w", err)
+	}
+
+	ansData, _ := json.Marshal(answer)
+	if err := m.send(Message{Type: "answer", To: msg.From, Data: ansData}); err != nil {
+		return err
+	}
+	slog.Info("Sent answer", "peer_id", msg.From)
+	return nil
+}
+
+// HandleAnswer applies a remote answer to the offer we sent earlier
+func (m *Mesh) HandleAnswer(msg Message) error {
+	var answer webrtc.SessionDescription
+	if err := json.Unmarshal(msg.Data, &answer); err != nil {
+		return fmt.Errorf("failed to parse answer: %w", err)
+	}
+
+	p, err := m.peer(msg.From)
+	if err != nil {
+		return err
+	}
+	if err := p.pc.SetRemoteDescription(answer); err != nil {
+		return fmt.Errorf("failed to set remote description: %w", err)
+	}
+	p.flushCandidates()
+	return nil
+}
+
+// HandleCandidate adds a remote ICE candidate, queueing it until the remote
+// description is known
+func (m *Mesh) HandleCandidate(msg Message) error {
+	var candidate webrtc.ICECandidateInit
+	if err := json.Unmarshal(msg.Data, &candidate); err != nil {
+		return fmt.Errorf("failed to parse candidate: %w", err)
+	}
+
+	p, err := m.peer(msg.From)
+	if err != nil {
+		return err
+	}
+
+	if p.pc.RemoteDescription() == nil {
+		// Queue candidate if remote description is not set yet
+		p.pendingCandidates = append(p.pendingCandidates, candidate)
+		return nil
+	}
+	if err := p.pc.AddICECandidate(candidate); err != nil {
+		return fmt.Errorf("failed to add ICE candidate: %w", err)
+	}
+	return nil
+}
+
+// flushCandidates applies any queued candidates once the remote description
+// has been set
+func (p *Peer) flushCandidates() {
+	for _, c := range p.pendingCandidates {
+		if err := p.pc.AddICECandidate(c); err != nil {
+			slog.Warn("Failed to add queued ICE candidate", "peer_id", p.ID, "err", err)
+		}
+	}
+	p.pendingCandidates = nil
+}
+
+// close tears down the PeerConnection and any ffplay windows for p
+func (p *Peer) close() {
+	if err := p.pc.Close(); err != nil {
+		slog.Warn("Failed to close PeerConnection", "peer_id", p.ID, "err", err)
+	}
+
+	p.viewsMu.Lock()
+	defer p.viewsMu.Unlock()
+	for _, cmd := range p.views {
+		if cmd.Process != nil {
+			cmd.Process.Kill()
+		}
+	}
+	p.views = nil
+}
+
+// Remove tears down the PeerConnection for a peer that left the room
+func (m *Mesh) Remove(id string) {
+	m.mu.Lock()
+	p, ok := m.peers[id]
+	delete(m.peers, id)
+	remaining := len(m.peers)
+	m.mu.Unlock()
+
+	if !ok {
+		return
+	}
+	p.close()
+	slog.Info("Closed PeerConnection", "peer_id", id, "peers", remaining)
+}
+
+// CloseAll closes every PeerConnection in the mesh
+func (m *Mesh) CloseAll() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, p := range m.peers {
+		p.close()
+		delete(m.peers, id)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+	"github.com/pion/webrtc/v4/pkg/media/oggwriter"
+)
+
+// Recorder saves remote tracks under Dir: VP8, VP9 and AV1 video as IVF,
+// H.264 as an Annex B byte stream, Opus audio as Ogg and, with WebM set, each
+// peer's VP8 video and audio muxed into one WebM file.
+// File names are made of the room, the peer ID and the time the recording
+// started.
+type Recorder struct {
+	Dir  string
+	Room string
+	WebM bool
+
+	mu    sync.Mutex
+	webms map[string]*webmFile // Peer ID -> WebM file being written
+}
+
+// NewRecorder creates dir if needed and returns a Recorder writing into it
+func NewRecorder(dir, room string, webm bool) (*Recorder, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create recording directory: %w", err)
+	}
+	return &Recorder{Dir: dir, Room: room, WebM: webm, webms: make(map[string]*webmFile)}, nil
+}
+
+// basePath returns the path, without extension, for a recording of peerID
+// starting now
+func (r *Recorder) basePath(peerID string) string {
+	name := fmt.Sprintf("%s_%s_%s", r.Room, peerID, time.Now().Format("20060102-150405"))
+	return filepath.Join(r.Dir, sanitizeFileName(name))
+}
+
+// Sinks opens the recordings for track, received from peerID
+func (r *Recorder) Sinks(peerID string, track *webrtc.TrackRemote, logger *slog.Logger) []media.Writer {
+	base := r.basePath(peerID)
+	codec := track.Codec()
+
+	var sink media.Writer
+	var path string
+	var err error
+	switch {
+	case isVideoMimeType(codec.MimeType):
+		path = base + "_video" + videoFileExt(codec.MimeType)
+		var f *os.File
+		if f, err = os.Create(path); err == nil {
+			if sink, err = newVideoWriter(f, codec.MimeType); err != nil {
+				f.Close()
+			}
+		}
+	case strings.EqualFold(codec.MimeType, webrtc.MimeTypeOpus):
+		path = base + "_audio.ogg"
+		sink, err = oggwriter.New(path, codec.ClockRate, codec.Channels)
+	default:
+		logger.Warn("Not recording track with unsupported codec", "codec", codec.MimeType)
+		return nil
+	}
+	if err != nil {
+		logger.Error("Failed to start recording", "file", path, "err", err)
+		return nil
+	}
+	logger.Info("Recording track", "file", path)
+	sinks := []media.Writer{sink}
+
+	if r.WebM && track.Kind() == webrtc.RTPCodecTypeVideo && !strings.EqualFold(codec.MimeType, webrtc.MimeTypeVP8) {
+		logger.Warn("Not adding track to WebM recording, only VP8 video is supported", "codec", codec.MimeType)
+	} else if r.WebM {
+		if w, err := r.webmTrack(peerID, base+".webm", track); err != nil {
+			logger.Error("Failed to start WebM recording", "err", err)
+		} else {
+			sinks = append(sinks, w)
+		}
+	}
+	return sinks
+}
+
+// webmTrack adds track to the WebM file of peerID, creating the file at path
+// for the peer's first track
+func (r *Recorder) webmTrack(peerID, path string, track *webrtc.TrackRemote) (media.Writer, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if f, ok := r.webms[peerID]; ok {
+		w, err := f.trackWriter(track)
+		if !errors.Is(err, errWebMClosed) {
+			return w, err
+		}
+	}
+
+	var f *webmFile
+	f, err := newWebMFile(path, func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if r.webms[peerID] == f {
+			delete(r.webms, peerID)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	r.webms[peerID] = f
+	slog.Info("Recording peer to WebM", "peer_id", peerID, "file", path)
+	return f.trackWriter(track)
+}
+
+// sanitizeFileName replaces characters that are unsafe in file names
+func sanitizeFileName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+			return r
+		default:
+			return '_'
+		}
+	}, name)
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	minReconnectDelay = time.Second
+	maxReconnectDelay = 30 * time.Second
+
+	// A connection must stay up this long for the backoff to start over,
+	// so a server that accepts and then drops us is not redialed in a loop
+	stableConnection = 30 * time.Second
+)
+
+var errNotConnected = errors.New("not connected to signaling server")
+
+// SignalingClient keeps a WebSocket connection to the signaling server open,
+// redialing with exponential backoff whenever it drops
+type SignalingClient struct {
+	url    string
+	header http.Header
+	dialer *websocket.Dialer
+
+	// Keepalive: ping the server every PingInterval and treat the connection
+	// as dead if nothing arrives for PongTimeout
+	PingInterval time.Duration
+	PongTimeout  time.Duration
+
+	mu   sync.Mutex // Guards conn and serializes writes
+	conn *websocket.Conn
+
+	stopOnce sync.Once
+	stopped  chan struct{} // Closed by Stop
+}
+
+// NewSignalingClient creates a client for the given ws:// or wss:// URL. If
+// token is set it is sent as a bearer token on every dial; tlsConfig is used
+// for wss:// connections. No connection is made until Run is called.
+func NewSignalingClient(url string, token string, tlsConfig *tls.Config) *SignalingClient {
+	header := http.Header{}
+	if token != "" {
+		header.Set("Authorization", "Bearer "+token)
+	}
+	dialer := *websocket.DefaultDialer
+	dialer.TLSClientConfig = tlsConfig
+	return &SignalingClient{
+		url:          url,
+		header:       header,
+		dialer:       &dialer,
+		PingInterval: 20 * time.Second,
+		PongTimeout:  60 * time.Second,
+		stopped:      make(chan struct{}),
+	}
+}
+
+// newTLSConfig builds the TLS settings for wss:// connections, trusting the
+// PEM certificates in caFile in addition to the system roots
+func newTLSConfig(caFile string, insecureSkipVerify bool) (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: insecureSkipVerify}
+	if caFile == "" {
+		return config, nil
+	}
+
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+	config.RootCAs = pool
+	return config, nil
+}
+
+// Send writes msg to the server, failing if the connection is currently down
+func (s *SignalingClient) Send(msg Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return errNotConnected
+	}
+	return s.conn.WriteJSON(msg)
+}
+
+// Close closes the current connection, if any
+func (s *SignalingClient) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn != nil {
+		s.conn.Close()
+	}
+}
+
+// Stop closes the connection for good: Run returns instead of redialing.
+// It may be called from handle.
+func (s *SignalingClient) Stop() {
+	s.stopOnce.Do(func() { close(s.stopped) })
+	s.Close()
+}
+
+// Stopped is closed once Stop has been called
+func (s *SignalingClient) Stopped() <-chan struct{} {
+	return s.stopped
+}
+
+func (s *SignalingClient) isStopped() bool {
+	select {
+	case <-s.stopped:
+		return true
+	default:
+		return false
+	}
+}
+
+// Run dials the server and passes every message it receives to handle. When
+// the connection fails or is closed it redials with exponential backoff,
+// calling onConnect after each successful dial so the caller can
+// resynchronize its state. Run only returns after Stop.
+func (s *SignalingClient) Run(onConnect func(reconnect bool), handle func(Message)) {
+	delay := minReconnectDelay
+	connected := false
+
+	for first := true; ; first = false {
+		if !first {
+			select {
+			case <-time.After(delay):
+			case <-s.stopped:
+				return
+			}
+			delay = min(delay*2, maxReconnectDelay)
+		}
+
+		conn, resp, err := s.dialer.Dial(s.url, s.header)
+		if err != nil {
+			if resp != nil && (resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden) {
+				slog.Error("Signaling server rejected our token (check -token)", "status", resp.Status)
+			}
+			slog.Warn("Failed to connect to signaling server", "err", err, "retry_in", delay)
+			continue
+		}
+		connectedAt := time.Now()
+
+		s.mu.Lock()
+		if s.isStopped() {
+			s.mu.Unlock()
+			conn.Close()
+			return
+		}
+		s.conn = conn
+		s.mu.Unlock()
+
+		slog.Info("Connected to signaling server", "url", s.url, "reconnect", connected)
+		onConnect(connected)
+		connected = true
+
+		stopKeepalive := s.startKeepalive(conn)
+		for {
+			var msg Message
+			if err := conn.ReadJSON(&msg); err != nil {
+				if s.isStopped() {
+					break
+				}
+				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+					slog.Warn("No response from signaling server, reconnecting", "timeout", s.PongTimeout)
+				} else {
+					slog.Warn("WebSocket read error", "err", err)
+				}
+				break
+			}
+			conn.SetReadDeadline(time.Now().Add(s.PongTimeout))
+			handle(msg)
+		}
+		stopKeepalive()
+
+		s.mu.Lock()
+		s.conn = nil
+		s.mu.Unlock()
+		conn.Close()
+
+		if s.isStopped() {
+			return
+		}
+		if time.Since(connectedAt) >= stableConnection {
+			delay = minReconnectDelay
+		}
+		slog.Info("Reconnecting to signaling server", "retry_in", delay)
+	}
+}
+
+// startKeepalive pings the server periodically and arms a read deadline that
+// every pong or message pushes back, so a half-open connection (e.g. after a
+// NAT timeout) is detected and redialed. The returned function stops the
+// pings.
+func (s *SignalingClient) startKeepalive(conn *websocket.Conn) (stop func()) {
+	conn.SetReadDeadline(time.Now().Add(s.PongTimeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(s.PongTimeout))
+	})
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(s.PingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(s.PingInterval)); err != nil {
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
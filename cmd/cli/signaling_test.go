@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	testPingInterval = 20 * time.Millisecond
+	testPongTimeout  = 100 * time.Millisecond
+)
+
+// keepaliveServer accepts WebSocket connections and counts them. Like the
+// signaling server, it pings each one and evicts it if no pong comes back
+// within testPongTimeout; with silent set it never reads, so it answers no
+// pings either.
+type keepaliveServer struct {
+	silent      bool
+	stop        chan struct{} // Closed to let silent connections go
+	connections atomic.Int32
+	evictions   atomic.Int32
+}
+
+func (k *keepaliveServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	k.connections.Add(1)
+	if k.silent {
+		<-k.stop
+		return
+	}
+
+	conn.SetReadDeadline(time.Now().Add(testPongTimeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(testPongTimeout))
+	})
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(testPingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(testPingInterval))
+			case <-done:
+				return
+			}
+		}
+	}()
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				k.evictions.Add(1)
+			}
+			return
+		}
+	}
+}
+
+// runClient connects a SignalingClient with short keepalive intervals to srv
+// until the test ends
+func runClient(t *testing.T, srv *httptest.Server) {
+	t.Helper()
+	s := NewSignalingClient("ws"+strings.TrimPrefix(srv.URL, "http"), "", nil)
+	s.PingInterval = testPingInterval
+	s.PongTimeout = testPongTimeout
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Run(func(bool) {}, func(Message) {})
+	}()
+	t.Cleanup(func() {
+		s.Stop()
+		<-done
+	})
+}
+
+func TestKeepaliveKeepsClientConnected(t *testing.T) {
+	k := &keepaliveServer{stop: make(chan struct{})}
+	srv := httptest.NewServer(k)
+	defer srv.Close()
+	defer close(k.stop)
+	runClient(t, srv)
+
+	time.Sleep(5 * testPongTimeout)
+	if n := k.evictions.Load(); n != 0 {
+		t.Errorf("Client evicted %d times although it sends nothing but pongs", n)
+	}
+	if n := k.connections.Load(); n != 1 {
+		t.Errorf("%d connections, want the client to stay on its first", n)
+	}
+}
+
+func TestKeepaliveDetectsSilentServer(t *testing.T) {
+	k := &keepaliveServer{silent: true, stop: make(chan struct{})}
+	srv := httptest.NewServer(k)
+	defer srv.Close()
+	defer close(k.stop)
+	runClient(t, srv)
+
+	// The client gives up on the connection after testPongTimeout and
+	// redials after minReconnectDelay
+	deadline := time.Now().Add(minReconnectDelay + time.Second)
+	for k.connections.Load() < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("Client never noticed the server stopped answering pings")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,571 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+	"github.com/pion/webrtc/v4/pkg/media/ivfreader"
+	"github.com/pion/webrtc/v4/pkg/media/oggreader"
+
+	"github.com/pion/mediadevices"
+	"github.com/pion/mediadevices/pkg/driver"
+	"github.com/pion/mediadevices/pkg/prop"
+	"github.com/pion/mediadevices/pkg/wave"
+)
+
+// Where local media comes from, selected with -video-source and
+// -audio-source. File sources are given as "file:<path>".
+const (
+	SourceCamera      = "camera"      // Capture video from a camera
+	SourceTestPattern = "testpattern" // Generate moving colour bars
+	SourceMic         = "mic"         // Capture audio from a microphone
+	SourceTone        = "tone"        // Generate a sine tone
+	SourceNone        = "none"        // Don't send this kind of media
+
+	sourceFilePrefix = "file:"
+)
+
+// Size and rate of captured and generated video unless -width, -height or
+// -fps say otherwise
+const (
+	videoWidth     = 640
+	videoHeight    = 480
+	videoFrameRate = 30
+)
+
+// Format of generated audio
+const (
+	toneFrequency  = 440 // Hz
+	toneSampleRate = 48000
+	toneChannels   = 2 // Unless -audio-channels says otherwise
+	toneChunk      = 20 * time.Millisecond
+)
+
+// parseSource checks spec against the sources allowed for one kind of media
+// and splits off the path of a file source
+func parseSource(spec string, allowed ...string) (kind, path string, err error) {
+	if p, ok := strings.CutPrefix(spec, sourceFilePrefix); ok {
+		if p == "" {
+			return "", "", fmt.Errorf("missing path in %q", spec)
+		}
+		return sourceFilePrefix, p, nil
+	}
+	for _, a := range allowed {
+		if spec == a {
+			return spec, "", nil
+		}
+	}
+	return "", "", fmt.Errorf("unknown source %q (want %s or file:<path>)", spec, strings.Join(allowed, ", "))
+}
+
+// openLocalTracks opens the video and audio sources described by videoSpec
+// and audioSpec, captured as settings ask. A missing camera or microphone is
+// skipped with a warning so the client can still receive, but one that
+// doesn't support the requested settings is an error, as is any other
+// failure. File sources are sent as they are, ignoring settings.
+func openLocalTracks(videoSpec, audioSpec string, settings MediaSettings, selector *mediadevices.CodecSelector) ([]webrtc.TrackLocal, error) {
+	var tracks []webrtc.TrackLocal
+
+	kind, path, err := parseSource(videoSpec, SourceCamera, SourceTestPattern, SourceNone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -video-source: %w", err)
+	}
+	switch kind {
+	case SourceCamera:
+		slog.Info("Requesting camera access")
+		stream, err := mediadevices.GetUserMedia(mediadevices.MediaStreamConstraints{
+			Video: func(c *mediadevices.MediaTrackConstraints) {
+				// Settings given explicitly must be met exactly, the
+				// defaults are only a preference
+				c.Width = prop.Int(videoWidth)
+				if settings.Width > 0 {
+					c.Width = prop.IntExact(settings.Width)
+				}
+				c.Height = prop.Int(videoHeight)
+				if settings.Height > 0 {
+					c.Height = prop.IntExact(settings.Height)
+				}
+				c.FrameRate = prop.Float(videoFrameRate)
+				if settings.FrameRate > 0 {
+					c.FrameRate = prop.FloatExact(float32(settings.FrameRate))
+				}
+			},
+			Codec: selector,
+		})
+		if err != nil {
+			modes := deviceModes(driver.FilterVideoRecorder(), func(p prop.Media) string {
+				return fmt.Sprintf("%dx%d@%g", p.Width, p.Height, p.FrameRate)
+			})
+			if len(modes) > 0 && (settings.Width > 0 || settings.Height > 0 || settings.FrameRate > 0) {
+				return nil, fmt.Errorf("camera doesn't support the requested -width, -height and -fps (supported: %s)", strings.Join(modes, ", "))
+			}
+			slog.Warn("Failed to open camera, continuing without local video", "err", err)
+			break
+		}
+		for _, track := range stream.GetTracks() {
+			tracks = append(tracks, track)
+		}
+	case SourceTestPattern:
+		width, height, frameRate := videoWidth, videoHeight, float64(videoFrameRate)
+		if settings.Width > 0 {
+			width = settings.Width
+		}
+		if settings.Height > 0 {
+			height = settings.Height
+		}
+		if settings.FrameRate > 0 {
+			frameRate = settings.FrameRate
+		}
+		tracks = append(tracks, mediadevices.NewVideoTrack(newTestPatternSource(width, height, frameRate), selector))
+	case sourceFilePrefix:
+		track, err := newIVFFileTrack(path)
+		if err != nil {
+			return nil, err
+		}
+		tracks = append(tracks, track)
+	}
+
+	kind, path, err = parseSource(audioSpec, SourceMic, SourceTone, SourceNone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -audio-source: %w", err)
+	}
+	switch kind {
+	case SourceMic:
+		slog.Info("Requesting microphone access")
+		stream, err := mediadevices.GetUserMedia(mediadevices.MediaStreamConstraints{
+			Audio: func(c *mediadevices.MediaTrackConstraints) {
+				if settings.AudioChannels > 0 {
+					c.ChannelCount = prop.IntExact(settings.AudioChannels)
+				}
+			},
+			Codec: selector,
+		})
+		if err != nil {
+			modes := deviceModes(driver.FilterAudioRecorder(), func(p prop.Media) string {
+				return fmt.Sprintf("%d channel(s) at %d Hz", p.ChannelCount, p.SampleRate)
+			})
+			if len(modes) > 0 && settings.AudioChannels > 0 {
+				return nil, fmt.Errorf("microphone doesn't support the requested -audio-channels (supported: %s)", strings.Join(modes, ", "))
+			}
+			slog.Warn("Failed to open microphone, continuing without local audio", "err", err)
+			break
+		}
+		for _, track := range stream.GetTracks() {
+			tracks = append(tracks, track)
+		}
+	case SourceTone:
+		channels := toneChannels
+		if settings.AudioChannels > 0 {
+			channels = settings.AudioChannels
+		}
+		tracks = append(tracks, mediadevices.NewAudioTrack(newToneSource(toneFrequency, channels), selector))
+	case sourceFilePrefix:
+		track, err := newOggFileTrack(path)
+		if err != nil {
+			return nil, err
+		}
+		tracks = append(tracks, track)
+	}
+
+	return tracks, nil
+}
+
+// deviceModes lists the distinct capture modes, formatted by describe, of
+// the devices that pass filter
+func deviceModes(filter driver.FilterFn, describe func(prop.Media) string) []string {
+	var modes []string
+	for _, d := range driver.GetManager().Query(filter) {
+		if d.Status() == driver.StateClosed {
+			if err := d.Open(); err != nil {
+				continue
+			}
+			defer d.Close()
+		}
+		for _, p := range d.Properties() {
+			if mode := describe(p); !slices.Contains(modes, mode) {
+				modes = append(modes, mode)
+			}
+		}
+	}
+	return modes
+}
+
+// testPatternSource generates colour bars with a white box sliding across
+// them, so frozen video is easy to tell apart from a live stream
+type testPatternSource struct {
+	width, height int
+	ticker        *time.Ticker
+	bars          *image.YCbCr
+	frame         int
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// Colour bars at 75% intensity, as Y, Cb, Cr
+var testPatternBars = [][3]uint8{
+	{180, 128, 128}, // White
+	{162, 44, 142},  // Yellow
+	{131, 156, 44},  // Cyan
+	{112, 72, 58},   // Green
+	{84, 184, 198},  // Magenta
+	{65, 100, 212},  // Red
+	{35, 212, 114},  // Blue
+}
+
+func newTestPatternSource(width, height int, frameRate float64) *testPatternSource {
+	bars := image.NewYCbCr(image.Rect(0, 0, width, height), image.YCbCrSubsampleRatio420)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			c := testPatternBars[x*len(testPatternBars)/width]
+			bars.Y[bars.YOffset(x, y)] = c[0]
+			bars.Cb[bars.COffset(x, y)] = c[1]
+			bars.Cr[bars.COffset(x, y)] = c[2]
+		}
+	}
+	return &testPatternSource{
+		width:  width,
+		height: height,
+		ticker: time.NewTicker(time.Duration(float64(time.Second) / frameRate)),
+		bars:   bars,
+		done:   make(chan struct{}),
+	}
+}
+
+func (s *testPatternSource) ID() string { return SourceTestPattern }
+
+func (s *testPatternSource) Close() error {
+	s.closeOnce.Do(func() {
+		s.ticker.Stop()
+		close(s.done)
+	})
+	return nil
+}
+
+// Read waits for the next frame time and returns the frame
+func (s *testPatternSource) Read() (image.Image, func(), error) {
+	select {
+	case <-s.done:
+		return nil, func() {}, io.EOF
+	case <-s.ticker.C:
+	}
+
+	img := image.NewYCbCr(s.bars.Rect, image.YCbCrSubsampleRatio420)
+	copy(img.Y, s.bars.Y)
+	copy(img.Cb, s.bars.Cb)
+	copy(img.Cr, s.bars.Cr)
+
+	// The box crosses the frame every four seconds or so
+	size := min(s.height/4, s.width/2)
+	left := (s.frame * 4) % (s.width - size)
+	top := (s.height - size) / 2
+	for y := top; y < top+size; y++ {
+		for x := left; x < left+size; x++ {
+			img.Y[img.YOffset(x, y)] = 235
+			img.Cb[img.COffset(x, y)] = 128
+			img.Cr[img.COffset(x, y)] = 128
+		}
+	}
+	s.frame++
+	return img, func() {}, nil
+}
+
+// toneSource generates a continuous sine tone
+type toneSource struct {
+	frequency float64
+	channels  int
+	next      time.Time // When the next chunk is due
+	phase     float64
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func newToneSource(frequency float64, channels int) *toneSource {
+	return &toneSource{frequency: frequency, channels: channels, done: make(chan struct{})}
+}
+
+func (s *toneSource) ID() string { return SourceTone }
+
+func (s *toneSource) Close() error {
+	s.closeOnce.Do(func() { close(s.done) })
+	return nil
+}
+
+// Read waits until the next chunk is due, so the tone plays in real time
+func (s *toneSource) Read() (wave.Audio, func(), error) {
+	if s.next.IsZero() {
+		s.next = time.Now()
+	}
+	select {
+	case <-s.done:
+		return nil, func() {}, io.EOF
+	case <-time.After(time.Until(s.next)):
+	}
+	s.next = s.next.Add(toneChunk)
+
+	samples := int(toneSampleRate * toneChunk / time.Second)
+	chunk := wave.NewInt16Interleaved(wave.ChunkInfo{
+		Len:          samples,
+		Channels:     s.channels,
+		SamplingRate: toneSampleRate,
+	})
+	step := 2 * math.Pi * s.frequency / toneSampleRate
+	for i := 0; i < samples; i++ {
+		v := wave.Int16Sample(math.Sin(s.phase) * math.MaxInt16 / 4)
+		for ch := 0; ch < s.channels; ch++ {
+			chunk.SetInt16(i, ch, v)
+		}
+		s.phase = math.Mod(s.phase+step, 2*math.Pi)
+	}
+	return chunk, func() {}, nil
+}
+
+// IVF FourCCs of the codecs we can replay
+var ivfMimeTypes = map[string]string{
+	"VP80": webrtc.MimeTypeVP8,
+	"VP90": webrtc.MimeTypeVP9,
+	"AV01": webrtc.MimeTypeAV1,
+}
+
+// newIVFFileTrack returns a track that replays the IVF file at path in a
+// loop. The frames are sent as they are, so the file's codec must be
+// negotiated with the remote peer.
+func newIVFFileTrack(path string) (webrtc.TrackLocal, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open video file: %w", err)
+	}
+	_, header, err := ivfreader.NewWith(f)
+	f.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read IVF header of %s: %w", path, err)
+	}
+	mimeType, ok := ivfMimeTypes[header.FourCC]
+	if !ok {
+		return nil, fmt.Errorf("unsupported codec %q in %s", header.FourCC, path)
+	}
+
+	sample, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: mimeType}, "video", "clive-file")
+	if err != nil {
+		return nil, err
+	}
+	// ivfreader hands out frame timestamps as the file's PTS times
+	// denominator/numerator; undo that to get back the PTS, which counts
+	// timebase units. elapsed is 0 unless to comes after from.
+	num, den := uint64(header.TimebaseNumerator), uint64(header.TimebaseDenominator)
+	elapsed := func(from, to *ivfreader.IVFFrameHeader) time.Duration {
+		start, end := from.Timestamp*num/den, to.Timestamp*num/den
+		if end <= start {
+			return 0
+		}
+		return time.Duration((end-start)*num) * time.Second / time.Duration(den)
+	}
+	logger := slog.With("file", path, "codec", mimeType)
+	logger.Info("Replaying video file", "width", header.Width, "height", header.Height)
+
+	track := newFileTrack(logger, path, sample)
+	go track.run(func(f *os.File) error {
+		reader, _, err := ivfreader.NewWith(f)
+		if err != nil {
+			return err
+		}
+		frame, frameHeader, err := reader.ParseNextFrame()
+		if err != nil {
+			return err
+		}
+		// A frame lasts until the next one's timestamp, so each is sent once
+		// the one after it has been read. The last frame, or one whose
+		// successor doesn't have a later timestamp, lasts as long as the one
+		// before it.
+		duration := time.Second / 30
+		next := time.Now()
+		for {
+			nextFrame, nextHeader, readErr := reader.ParseNextFrame()
+			if readErr == nil {
+				if d := elapsed(frameHeader, nextHeader); d > 0 {
+					duration = d
+				}
+			}
+			if err := track.WriteSample(media.Sample{Data: frame, Duration: duration}); err != nil {
+				return err
+			}
+			next = next.Add(duration)
+			if err := track.wait(next); err != nil {
+				return err
+			}
+			if readErr != nil {
+				return readErr
+			}
+			frame, frameHeader = nextFrame, nextHeader
+		}
+	})
+	return track, nil
+}
+
+// newOggFileTrack returns a track that replays the Ogg Opus file at path in
+// a loop
+func newOggFileTrack(path string) (webrtc.TrackLocal, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audio file: %w", err)
+	}
+	_, header, err := oggreader.NewWith(f)
+	f.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read Ogg Opus header of %s: %w", path, err)
+	}
+
+	sample, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, "audio", "clive-file")
+	if err != nil {
+		return nil, err
+	}
+	logger := slog.With("file", path, "codec", webrtc.MimeTypeOpus)
+	logger.Info("Replaying audio file", "channels", header.Channels, "sample_rate", header.SampleRate)
+
+	track := newFileTrack(logger, path, sample)
+	go track.run(func(f *os.File) error {
+		// Each Opus packet is one sample, however the file groups them
+		// into pages
+		reader := newOggPacketReader(f)
+		next := time.Now()
+		for {
+			packet, err := reader.ReadPacket()
+			if err != nil {
+				return err
+			}
+			if bytes.HasPrefix(packet, []byte("OpusHead")) || bytes.HasPrefix(packet, []byte("OpusTags")) {
+				continue
+			}
+			duration := opusPacketDuration(packet)
+			if duration == 0 {
+				continue
+			}
+			if err := track.WriteSample(media.Sample{Data: packet, Duration: duration}); err != nil {
+				return err
+			}
+			next = next.Add(duration)
+			if err := track.wait(next); err != nil {
+				return err
+			}
+		}
+	})
+	return track, nil
+}
+
+// Errors fileTrack.wait interrupts replay with
+var (
+	errReplayRewound = errors.New("replay rewound for a new peer")
+	errReplayStopped = errors.New("replay stopped")
+)
+
+// fileTrack is a track that replays a media file in a loop. Nothing is sent
+// until the first peer subscribes, and replay goes back to the start of the
+// file whenever another one does, so that each peer's stream starts with a
+// keyframe rather than waiting for the file to come round again.
+type fileTrack struct {
+	*webrtc.TrackLocalStaticSample
+
+	logger *slog.Logger
+	path   string
+
+	rewind    chan struct{} // Signalled when a peer subscribes
+	closeOnce sync.Once
+	closed    chan struct{}
+	done      chan struct{} // Closed once run returns
+}
+
+func newFileTrack(logger *slog.Logger, path string, sample *webrtc.TrackLocalStaticSample) *fileTrack {
+	return &fileTrack{
+		TrackLocalStaticSample: sample,
+		logger:                 logger,
+		path:                   path,
+		rewind:                 make(chan struct{}, 1),
+		closed:                 make(chan struct{}),
+		done:                   make(chan struct{}),
+	}
+}
+
+// Bind subscribes a peer and starts replay over from the beginning
+func (t *fileTrack) Bind(ctx webrtc.TrackLocalContext) (webrtc.RTPCodecParameters, error) {
+	params, err := t.TrackLocalStaticSample.Bind(ctx)
+	if err == nil {
+		t.restart()
+	}
+	return params, err
+}
+
+// restart makes replay go back to the start of the file
+func (t *fileTrack) restart() {
+	select {
+	case t.rewind <- struct{}{}:
+	default: // Already pending
+	}
+}
+
+// Close stops replay and waits for it to end
+func (t *fileTrack) Close() error {
+	t.closeOnce.Do(func() { close(t.closed) })
+	<-t.done
+	return nil
+}
+
+// wait sleeps until the time the next sample is due. It fails with
+// errReplayRewound when replay has to start over, and with errReplayStopped
+// once the track is closed.
+func (t *fileTrack) wait(until time.Time) error {
+	timer := time.NewTimer(time.Until(until))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-t.rewind:
+		return errReplayRewound
+	case <-t.closed:
+		return errReplayStopped
+	}
+}
+
+// run waits for the first peer, then calls play with the file opened until
+// play fails with anything but the end of the file or a rewind, or the track
+// is closed
+func (t *fileTrack) run(play func(*os.File) error) {
+	defer close(t.done)
+	select {
+	case <-t.rewind:
+	case <-t.closed:
+		return
+	}
+	for {
+		f, err := os.Open(t.path)
+		if err != nil {
+			t.logger.Error("Failed to reopen media file", "err", err)
+			return
+		}
+		err = play(f)
+		f.Close()
+		switch {
+		case errors.Is(err, errReplayStopped):
+			return
+		case errors.Is(err, errReplayRewound):
+			t.logger.Debug("Peer subscribed, starting media file over")
+		case errors.Is(err, io.EOF):
+			t.logger.Debug("Reached end of media file, starting over")
+		default:
+			t.logger.Error("Stopped replaying media file", "err", err)
+			return
+		}
+	}
+}
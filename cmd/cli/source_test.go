@@ -0,0 +1,67 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+func TestFileTrack(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "clip.ivf")
+	if err := os.WriteFile(path, []byte("clip"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	sample, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8}, "video", "clive-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	track := newFileTrack(slog.Default(), path, sample)
+
+	// Each play sends one sample, then waits for the next one, which is
+	// never due
+	plays := make(chan struct{}, 10)
+	go track.run(func(f *os.File) error {
+		plays <- struct{}{}
+		return track.wait(time.Now().Add(time.Hour))
+	})
+	expectPlays := func(want int) {
+		t.Helper()
+		got := 0
+		timeout := time.After(100 * time.Millisecond)
+		for {
+			select {
+			case <-plays:
+				got++
+				continue
+			case <-timeout:
+			}
+			break
+		}
+		if got != want {
+			t.Fatalf("File played from the start %d times, want %d", got, want)
+		}
+	}
+
+	expectPlays(0)
+	track.restart()
+	expectPlays(1)
+	track.restart()
+	expectPlays(1)
+
+	closed := make(chan struct{})
+	go func() {
+		track.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Close didn't stop replay")
+	}
+	track.restart()
+	expectPlays(0)
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+	"github.com/pion/webrtc/v4/pkg/media/samplebuilder"
+)
+
+// Track numbers in the WebM files we write
+const (
+	webmVideoTrack = 1
+	webmAudioTrack = 2
+)
+
+// How many packets the WebM sample builders wait for a missing one
+const webmMaxLate = 128
+
+// How long audio is held back waiting for a video track before the file is
+// written with audio only
+const webmVideoWait = 5 * time.Second
+
+var (
+	errWebMClosed  = errors.New("WebM file closed")
+	errWebMStarted = errors.New("WebM file already started without video")
+)
+
+// EBML element IDs used in WebM files
+const (
+	ebmlHeaderID         = 0x1A45DFA3
+	ebmlVersionID        = 0x4286
+	ebmlReadVersionID    = 0x42F7
+	ebmlMaxIDLengthID    = 0x42F2
+	ebmlMaxSizeLengthID  = 0x42F3
+	ebmlDocTypeID        = 0x4282
+	ebmlDocTypeVerID     = 0x4287
+	ebmlDocTypeReadVerID = 0x4285
+	mkvSegmentID         = 0x18538067
+	mkvInfoID            = 0x1549A966
+	mkvTimecodeScaleID   = 0x2AD7B1
+	mkvMuxingAppID       = 0x4D80
+	mkvWritingAppID      = 0x5741
+	mkvTracksID          = 0x1654AE6B
+	mkvTrackEntryID      = 0xAE
+	mkvTrackNumberID     = 0xD7
+	mkvTrackUIDID        = 0x73C5
+	mkvTrackTypeID       = 0x83
+	mkvCodecIDID         = 0x86
+	mkvCodecPrivateID    = 0x63A2
+	mkvVideoID           = 0xE0
+	mkvPixelWidthID      = 0xB0
+	mkvPixelHeightID     = 0xBA
+	mkvAudioID           = 0xE1
+	mkvSamplingFreqID    = 0xB5
+	mkvChannelsID        = 0x9F
+	mkvClusterID         = 0x1F43B675
+	mkvTimecodeID        = 0xE7
+	mkvSimpleBlockID     = 0xA3
+)
+
+// Size of a master element whose length is not known up front, which lets
+// the file be written as a stream
+var ebmlUnknownSize = []byte{0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
+
+// webmFile muxes a peer's VP8 video and Opus audio into one WebM file. Both
+// tracks are placed on a common timeline starting when the file was created.
+// The header needs the video frame size, so with a video track nothing is
+// written until its first keyframe arrives. Without one, audio is held back
+// for webmVideoWait in case a video track turns up, then written alone. A
+// file that never got anything to write is removed.
+type webmFile struct {
+	mu            sync.Mutex
+	f             *os.File
+	start         time.Time
+	hasVideo      bool   // A video track was added
+	channels      uint16 // Of the audio track, 2 until one is added
+	headerWritten bool
+	audioOnly     bool // The header has no video track
+	pending       []webmFrame
+	clusterOpen   bool
+	clusterTime   int64 // Milliseconds
+	refs          int   // Open track writers
+	closed        bool
+	onClose       func()
+}
+
+// webmFrame is an audio frame held back until the header can be written
+type webmFrame struct {
+	ts    int64
+	frame []byte
+}
+
+// newWebMFile creates the file at path; onClose runs once every track writer
+// has been closed
+func newWebMFile(path string, onClose func()) (*webmFile, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &webmFile{f: f, start: time.Now(), channels: 2, onClose: onClose}, nil
+}
+
+// trackWriter returns a writer for one of the peer's tracks. It fails with
+// errWebMClosed if the file has already been closed.
+func (w *webmFile) trackWriter(track *webrtc.TrackRemote) (media.Writer, error) {
+	codec := track.Codec()
+	return w.newTrackWriter(track.Kind(), codec.ClockRate, codec.Channels)
+}
+
+func (w *webmFile) newTrackWriter(kind webrtc.RTPCodecType, clockRate uint32, channels uint16) (media.Writer, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return nil, errWebMClosed
+	}
+	if kind == webrtc.RTPCodecTypeVideo {
+		if w.audioOnly {
+			return nil, errWebMStarted
+		}
+		w.hasVideo = true
+	} else if channels > 0 && !w.headerWritten {
+		w.channels = channels
+	}
+	w.refs++
+
+	t := &webmTrackWriter{file: w, clockRate: clockRate}
+	if kind == webrtc.RTPCodecTypeVideo {
+		t.number = webmVideoTrack
+		t.builder = samplebuilder.New(webmMaxLate, &codecs.VP8Packet{}, clockRate)
+	} else {
+		t.number = webmAudioTrack
+		t.builder = samplebuilder.New(webmMaxLate, &codecs.OpusPacket{}, clockRate)
+	}
+	return t, nil
+}
+
+func (w *webmFile) release() {
+	w.mu.Lock()
+	w.refs--
+	done := w.refs == 0 && !w.closed
+	if done {
+		w.closed = true
+		if !w.headerWritten && !w.hasVideo && len(w.pending) > 0 {
+			// The peer left before webmVideoWait was up
+			if err := w.writeAudioOnly(); err != nil {
+				slog.Warn("Failed to write WebM file", "file", w.f.Name(), "err", err)
+			}
+		}
+		w.f.Close()
+		if !w.headerWritten {
+			os.Remove(w.f.Name())
+		}
+	}
+	w.mu.Unlock()
+
+	if done && w.onClose != nil {
+		w.onClose()
+	}
+}
+
+// writeSample adds one frame at ts milliseconds to the file
+func (w *webmFile) writeSample(track int, ts int64, frame []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	keyframe := track == webmAudioTrack || isVP8Keyframe(frame)
+	if !w.headerWritten {
+		switch {
+		case track == webmVideoTrack:
+			if !keyframe {
+				return nil
+			}
+			width, height := vp8FrameSize(frame)
+			if _, err := w.f.Write(webmHeader(true, width, height, w.channels)); err != nil {
+				return err
+			}
+			w.headerWritten = true
+			w.pending = nil // The file starts at the first keyframe
+		case w.hasVideo:
+			return nil
+		default:
+			w.pending = append(w.pending, webmFrame{ts: ts, frame: bytes.Clone(frame)})
+			if time.Since(w.start) < webmVideoWait {
+				return nil
+			}
+			return w.writeAudioOnly()
+		}
+	}
+	return w.writeBlock(track, ts, keyframe, frame)
+}
+
+// writeAudioOnly writes a header without a video track, followed by the
+// audio held back so far. w.mu must be held.
+func (w *webmFile) writeAudioOnly() error {
+	if _, err := w.f.Write(webmHeader(false, 0, 0, w.channels)); err != nil {
+		return err
+	}
+	w.headerWritten = true
+	w.audioOnly = true
+	pending := w.pending
+	w.pending = nil
+	for _, f := range pending {
+		if err := w.writeBlock(webmAudioTrack, f.ts, true, f.frame); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeBlock writes frame as a SimpleBlock, starting a new cluster first if
+// needed. w.mu must be held.
+func (w *webmFile) writeBlock(track int, ts int64, keyframe bool, frame []byte) error {
+	// Start a new cluster on every video keyframe so players can seek, and
+	// whenever the block timecode no longer fits its 16-bit offset
+	rel := ts - w.clusterTime
+	if !w.clusterOpen || (track == webmVideoTrack && keyframe) || rel > math.MaxInt16 || rel < math.MinInt16 {
+		var cluster bytes.Buffer
+		cluster.Write(ebmlID(mkvClusterID))
+		cluster.Write(ebmlUnknownSize)
+		cluster.Write(ebmlUint(mkvTimecodeID, uint64(max(ts, 0))))
+		if _, err := w.f.Write(cluster.Bytes()); err != nil {
+			return err
+		}
+		w.clusterOpen = true
+		w.clusterTime = max(ts, 0)
+		rel = ts - w.clusterTime
+	}
+
+	block := make([]byte, 4, 4+len(frame))
+	block[0] = 0x80 | byte(track)
+	binary.BigEndian.PutUint16(block[1:3], uint16(int16(rel)))
+	if keyframe {
+		block[3] = 0x80
+	}
+	block = append(block, frame...)
+	_, err := w.f.Write(ebmlElement(mkvSimpleBlockID, block))
+	return err
+}
+
+// webmTrackWriter turns one RTP track into frames for a webmFile
+type webmTrackWriter struct {
+	file      *webmFile
+	number    int
+	clockRate uint32
+	builder   *samplebuilder.SampleBuilder
+
+	started bool
+	firstTS uint32        // RTP timestamp of the first frame
+	offset  time.Duration // When the first frame arrived, relative to the file start
+}
+
+// WriteRTP adds pkt to the track, writing every frame it completes
+func (t *webmTrackWriter) WriteRTP(pkt *rtp.Packet) error {
+	t.builder.Push(pkt)
+	for sample := t.builder.Pop(); sample != nil; sample = t.builder.Pop() {
+		if !t.started {
+			t.started = true
+			t.firstTS = sample.PacketTimestamp
+			t.offset = time.Since(t.file.start)
+		}
+		elapsed := time.Duration(sample.PacketTimestamp-t.firstTS) * time.Second / time.Duration(t.clockRate)
+		if err := t.file.writeSample(t.number, (t.offset + elapsed).Milliseconds(), sample.Data); err != nil {
+			return fmt.Errorf("failed to write WebM frame: %w", err)
+		}
+	}
+	return nil
+}
+
+// Close detaches the track; the file is closed with its last track
+func (t *webmTrackWriter) Close() error {
+	t.file.release()
+	return nil
+}
+
+// isVP8Keyframe reports whether frame is a VP8 key frame
+func isVP8Keyframe(frame []byte) bool {
+	return len(frame) >= 10 && frame[0]&0x01 == 0 &&
+		frame[3] == 0x9d && frame[4] == 0x01 && frame[5] == 0x2a
+}
+
+// vp8FrameSize reads the dimensions from a VP8 key frame header
+func vp8FrameSize(frame []byte) (width, height uint64) {
+	width = uint64(binary.LittleEndian.Uint16(frame[6:8]) & 0x3fff)
+	height = uint64(binary.LittleEndian.Uint16(frame[8:10]) & 0x3fff)
+	return width, height
+}
+
+// webmHeader returns the EBML header, the start of the segment, and the
+// segment info and track list for a VP8 + Opus file, or an Opus only one
+// without video
+func webmHeader(video bool, width, height uint64, channels uint16) []byte {
+	// Opus identification header, as stored in CodecPrivate
+	opusHead := make([]byte, 19)
+	copy(opusHead, "OpusHead")
+	opusHead[8] = 1 // Version
+	opusHead[9] = byte(channels)
+	binary.LittleEndian.PutUint32(opusHead[12:16], 48000)
+
+	var buf bytes.Buffer
+	buf.Write(ebmlMaster(ebmlHeaderID,
+		ebmlUint(ebmlVersionID, 1),
+		ebmlUint(ebmlReadVersionID, 1),
+		ebmlUint(ebmlMaxIDLengthID, 4),
+		ebmlUint(ebmlMaxSizeLengthID, 8),
+		ebmlString(ebmlDocTypeID, "webm"),
+		ebmlUint(ebmlDocTypeVerID, 4),
+		ebmlUint(ebmlDocTypeReadVerID, 2),
+	))
+	buf.Write(ebmlID(mkvSegmentID))
+	buf.Write(ebmlUnknownSize)
+	buf.Write(ebmlMaster(mkvInfoID,
+		ebmlUint(mkvTimecodeScaleID, uint64(time.Millisecond)),
+		ebmlString(mkvMuxingAppID, "clive"),
+		ebmlString(mkvWritingAppID, "clive"),
+	))
+	var tracks [][]byte
+	if video {
+		tracks = append(tracks, ebmlMaster(mkvTrackEntryID,
+			ebmlUint(mkvTrackNumberID, webmVideoTrack),
+			ebmlUint(mkvTrackUIDID, webmVideoTrack),
+			ebmlUint(mkvTrackTypeID, 1),
+			ebmlString(mkvCodecIDID, "V_VP8"),
+			ebmlMaster(mkvVideoID,
+				ebmlUint(mkvPixelWidthID, width),
+				ebmlUint(mkvPixelHeightID, height),
+			),
+		))
+	}
+	tracks = append(tracks, ebmlMaster(mkvTrackEntryID,
+		ebmlUint(mkvTrackNumberID, webmAudioTrack),
+		ebmlUint(mkvTrackUIDID, webmAudioTrack),
+		ebmlUint(mkvTrackTypeID, 2),
+		ebmlString(mkvCodecIDID, "A_OPUS"),
+		ebmlElement(mkvCodecPrivateID, opusHead),
+		ebmlMaster(mkvAudioID,
+			ebmlFloat(mkvSamplingFreqID, 48000),
+			ebmlUint(mkvChannelsID, uint64(channels)),
+		),
+	))
+	buf.Write(ebmlMaster(mkvTracksID, tracks...))
+	return buf.Bytes()
+}
+
+// ebmlID encodes an element ID, which already carries its length marker
+func ebmlID(id uint32) []byte {
+	b := binary.BigEndian.AppendUint32(nil, id)
+	for len(b) > 1 && b[0] == 0 {
+		b = b[1:]
+	}
+	return b
+}
+
+// ebmlSize encodes n as a variable-length size
+func ebmlSize(n int) []byte {
+	length := 1
+	for length < 8 && uint64(n) >= 1<<(7*length)-1 {
+		length++
+	}
+	v := uint64(n) | 1<<(7*length)
+	b := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		b[i] = byte(v)
+		v >>= 8
+	}
+	return b
+}
+
+func ebmlElement(id uint32, payload []byte) []byte {
+	b := ebmlID(id)
+	b = append(b, ebmlSize(len(payload))...)
+	return append(b, payload...)
+}
+
+func ebmlMaster(id uint32, children ...[]byte) []byte {
+	return ebmlElement(id, bytes.Join(children, nil))
+}
+
+func ebmlUint(id uint32, v uint64) []byte {
+	b := binary.BigEndian.AppendUint64(nil, v)
+	for len(b) > 1 && b[0] == 0 {
+		b = b[1:]
+	}
+	return ebmlElement(id, b)
+}
+
+func ebmlFloat(id uint32, v float64) []byte {
+	return ebmlElement(id, binary.BigEndian.AppendUint64(nil, math.Float64bits(v)))
+}
+
+func ebmlString(id uint32, s string) []byte {
+	return ebmlElement(id, []byte(s))
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+)
+
+// ebmlNode is an element read back from a WebM file
+type ebmlNode struct {
+	id       uint32
+	data     []byte
+	children []ebmlNode
+}
+
+// Master elements whose children are parsed
+var webmMasters = map[uint32]bool{
+	ebmlHeaderID:    true,
+	mkvSegmentID:    true,
+	mkvInfoID:       true,
+	mkvTracksID:     true,
+	mkvTrackEntryID: true,
+	mkvVideoID:      true,
+	mkvAudioID:      true,
+	mkvClusterID:    true,
+}
+
+// parseEBML reads the elements in b up to its end, or up to the first
+// element with ID stop, which ends a sibling of unknown size
+func parseEBML(t *testing.T, b []byte, stop uint32) (nodes []ebmlNode, n int) {
+	t.Helper()
+	for n < len(b) {
+		idLen := bits.LeadingZeros8(b[n]) + 1
+		sizeStart := n + idLen
+		if idLen > 4 || sizeStart >= len(b) {
+			t.Fatalf("Truncated element ID at %d", n)
+		}
+		var id uint32
+		for _, c := range b[n:sizeStart] {
+			id = id<<8 | uint32(c)
+		}
+		if stop != 0 && id == stop {
+			return nodes, n
+		}
+
+		sizeLen := bits.LeadingZeros8(b[sizeStart]) + 1
+		start := sizeStart + sizeLen
+		if sizeLen > 8 || start > len(b) {
+			t.Fatalf("Truncated size of element %x", id)
+		}
+		if bytes.Equal(b[sizeStart:start], ebmlUnknownSize) {
+			// Runs to the end of its parent, or for a cluster, to the next one
+			var end uint32
+			if id == mkvClusterID {
+				end = mkvClusterID
+			}
+			children, m := parseEBML(t, b[start:], end)
+			nodes = append(nodes, ebmlNode{id: id, children: children})
+			n = start + m
+			continue
+		}
+
+		size := uint64(b[sizeStart] & (0xff >> sizeLen))
+		for _, c := range b[sizeStart+1 : start] {
+			size = size<<8 | uint64(c)
+		}
+		if size > uint64(len(b)-start) {
+			t.Fatalf("Element %x overruns its parent", id)
+		}
+		node := ebmlNode{id: id, data: b[start : start+int(size)]}
+		if webmMasters[id] {
+			node.children, _ = parseEBML(t, node.data, 0)
+		}
+		nodes = append(nodes, node)
+		n = start + int(size)
+	}
+	return nodes, n
+}
+
+// find returns the children of nodes with the given ID
+func find(nodes []ebmlNode, id uint32) []ebmlNode {
+	var found []ebmlNode
+	for _, node := range nodes {
+		if node.id == id {
+			found = append(found, node)
+		}
+	}
+	return found
+}
+
+func (n ebmlNode) uint(id uint32) uint64 {
+	var v uint64
+	for _, child := range find(n.children, id) {
+		for _, c := range child.data {
+			v = v<<8 | uint64(c)
+		}
+	}
+	return v
+}
+
+func (n ebmlNode) string(id uint32) string {
+	for _, child := range find(n.children, id) {
+		return string(child.data)
+	}
+	return ""
+}
+
+// webmBlock is a SimpleBlock read back from a WebM file
+type webmBlock struct {
+	track    int
+	ts       int64 // Milliseconds
+	keyframe bool
+	frame    []byte
+}
+
+// readWebM parses the WebM file at path, returning the codec IDs of its
+// tracks by track number and its blocks in order
+func readWebM(t *testing.T, path string) (segment ebmlNode, codecs map[int]string, blocks []webmBlock) {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes, _ := parseEBML(t, b, 0)
+	if len(nodes) != 2 || nodes[0].id != ebmlHeaderID || nodes[1].id != mkvSegmentID {
+		t.Fatalf("Want an EBML header and a segment, got %d top level elements", len(nodes))
+	}
+	if docType := nodes[0].string(ebmlDocTypeID); docType != "webm" {
+		t.Errorf("DocType = %q, want webm", docType)
+	}
+	segment = nodes[1]
+
+	codecs = make(map[int]string)
+	for _, tracks := range find(segment.children, mkvTracksID) {
+		for _, entry := range find(tracks.children, mkvTrackEntryID) {
+			codecs[int(entry.uint(mkvTrackNumberID))] = entry.string(mkvCodecIDID)
+		}
+	}
+
+	for _, cluster := range find(segment.children, mkvClusterID) {
+		clusterTime := int64(cluster.uint(mkvTimecodeID))
+		for _, block := range find(cluster.children, mkvSimpleBlockID) {
+			if len(block.data) < 4 || block.data[0]&0x80 == 0 {
+				t.Fatalf("Malformed SimpleBlock % x", block.data)
+			}
+			blocks = append(blocks, webmBlock{
+				track:    int(block.data[0] & 0x7f),
+				ts:       clusterTime + int64(int16(binary.BigEndian.Uint16(block.data[1:3]))),
+				keyframe: block.data[3]&0x80 != 0,
+				frame:    block.data[4:],
+			})
+		}
+	}
+	return segment, codecs, blocks
+}
+
+// vp8Frame returns a VP8 frame of width x height starting with the given
+// bytes after its header
+func vp8Frame(keyframe bool, width, height uint16, body ...byte) []byte {
+	frame := make([]byte, 10)
+	if !keyframe {
+		frame[0] = 0x01
+	}
+	copy(frame[3:6], []byte{0x9d, 0x01, 0x2a})
+	binary.LittleEndian.PutUint16(frame[6:8], width)
+	binary.LittleEndian.PutUint16(frame[8:10], height)
+	return append(frame, body...)
+}
+
+// writeFrames sends each frame to w as one RTP packet, timestamps step
+// apart, and one more so the last frame is complete. A VP8 payload
+// descriptor is added with vp8 set.
+func writeFrames(t *testing.T, w media.Writer, vp8 bool, step uint32, frames ...[]byte) {
+	t.Helper()
+	for i, frame := range append(frames, []byte{0xff}) {
+		payload := frame
+		if vp8 {
+			payload = append([]byte{0x10}, frame...) // Start of partition 0
+		}
+		pkt := &rtp.Packet{
+			Header: rtp.Header{
+				Version:        2,
+				Marker:         true,
+				SequenceNumber: uint16(1000 + i),
+				Timestamp:      uint32(i) * step,
+			},
+			Payload: payload,
+		}
+		if err := w.WriteRTP(pkt); err != nil {
+			t.Fatalf("WriteRTP: %v", err)
+		}
+	}
+}
+
+func TestWebMRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "peer.webm")
+	closed := false
+	f, err := newWebMFile(path, func() { closed = true })
+	if err != nil {
+		t.Fatal(err)
+	}
+	video, err := f.newTrackWriter(webrtc.RTPCodecTypeVideo, 90000, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	audio, err := f.newTrackWriter(webrtc.RTPCodecTypeAudio, 48000, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	videoFrames := [][]byte{
+		vp8Frame(true, 640, 480, 1, 2, 3),
+		vp8Frame(false, 640, 480, 4, 5),
+		vp8Frame(false, 640, 480, 6),
+		vp8Frame(true, 640, 480, 7, 8),
+	}
+	audioFrames := [][]byte{{0x10, 1}, {0x10, 2}, {0x10, 3}}
+	writeFrames(t, video, true, 3600, videoFrames...)
+	writeFrames(t, audio, false, 960, audioFrames...)
+	video.Close()
+	if closed {
+		t.Fatal("File closed with a track still open")
+	}
+	audio.Close()
+	if !closed {
+		t.Fatal("File not closed with its last track")
+	}
+
+	segment, codecs, blocks := readWebM(t, path)
+	if codecs[webmVideoTrack] != "V_VP8" || codecs[webmAudioTrack] != "A_OPUS" || len(codecs) != 2 {
+		t.Errorf("Tracks = %v, want VP8 video and Opus audio", codecs)
+	}
+	tracks := find(segment.children, mkvTracksID)[0]
+	videoSettings := find(find(tracks.children, mkvTrackEntryID)[0].children, mkvVideoID)[0]
+	if w, h := videoSettings.uint(mkvPixelWidthID), videoSettings.uint(mkvPixelHeightID); w != 640 || h != 480 {
+		t.Errorf("Frame size = %dx%d, want 640x480", w, h)
+	}
+	if n := len(find(segment.children, mkvClusterID)); n < 2 {
+		t.Errorf("%d clusters, want one per video keyframe", n)
+	}
+
+	var gotVideo, gotAudio [][]byte
+	var lastVideo int64 = -1
+	for _, block := range blocks {
+		switch block.track {
+		case webmVideoTrack:
+			if want := isVP8Keyframe(block.frame); block.keyframe != want {
+				t.Errorf("Video block %d keyframe flag = %v, want %v", len(gotVideo), block.keyframe, want)
+			}
+			if lastVideo >= 0 && block.ts-lastVideo != 40 {
+				t.Errorf("Video block %d is %d ms after the previous one, want 40", len(gotVideo), block.ts-lastVideo)
+			}
+			lastVideo = block.ts
+			gotVideo = append(gotVideo, block.frame)
+		case webmAudioTrack:
+			gotAudio = append(gotAudio, block.frame)
+		default:
+			t.Errorf("Block for unknown track %d", block.track)
+		}
+	}
+	if !equalFrames(gotVideo, videoFrames) {
+		t.Errorf("Video frames = %x, want %x", gotVideo, videoFrames)
+	}
+	if !equalFrames(gotAudio, audioFrames) {
+		t.Errorf("Audio frames = %x, want %x", gotAudio, audioFrames)
+	}
+}
+
+func TestWebMAudioOnly(t *testing.T) {
+	audioFrames := [][]byte{{0x10, 1}, {0x10, 2}}
+	for _, tt := range []struct {
+		name   string
+		waited bool // webmVideoWait is up before the first frame
+	}{
+		{name: "peer leaves while waiting for video"},
+		{name: "no video turns up", waited: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "peer.webm")
+			f, err := newWebMFile(path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.waited {
+				f.start = f.start.Add(-webmVideoWait)
+			}
+			audio, err := f.newTrackWriter(webrtc.RTPCodecTypeAudio, 48000, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			writeFrames(t, audio, false, 960, audioFrames...)
+			if tt.waited {
+				if _, err := f.newTrackWriter(webrtc.RTPCodecTypeVideo, 90000, 0); !errors.Is(err, errWebMStarted) {
+					t.Errorf("Adding video after the header = %v, want %v", err, errWebMStarted)
+				}
+			}
+			audio.Close()
+
+			segment, codecs, blocks := readWebM(t, path)
+			if codecs[webmAudioTrack] != "A_OPUS" || len(codecs) != 1 {
+				t.Fatalf("Tracks = %v, want Opus audio only", codecs)
+			}
+			entry := find(find(segment.children, mkvTracksID)[0].children, mkvTrackEntryID)[0]
+			if channels := find(entry.children, mkvAudioID)[0].uint(mkvChannelsID); channels != 1 {
+				t.Errorf("Channels = %d, want the track's 1", channels)
+			}
+			if opusHead := find(entry.children, mkvCodecPrivateID)[0].data; len(opusHead) < 10 || opusHead[9] != 1 {
+				t.Errorf("OpusHead % x, want 1 channel", opusHead)
+			}
+			var got [][]byte
+			for _, block := range blocks {
+				got = append(got, block.frame)
+			}
+			if !equalFrames(got, audioFrames) {
+				t.Errorf("Audio frames = %x, want %x", got, audioFrames)
+			}
+		})
+	}
+}
+
+func TestWebMWithoutKeyframeIsRemoved(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "peer.webm")
+	f, err := newWebMFile(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	video, _ := f.newTrackWriter(webrtc.RTPCodecTypeVideo, 90000, 0)
+	audio, _ := f.newTrackWriter(webrtc.RTPCodecTypeAudio, 48000, 2)
+	writeFrames(t, video, true, 3000, vp8Frame(false, 640, 480, 1))
+	writeFrames(t, audio, false, 960, []byte{0x10, 1})
+	video.Close()
+	audio.Close()
+
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Empty WebM file left behind: %v", err)
+	}
+}
+
+func equalFrames(a, b [][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !bytes.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
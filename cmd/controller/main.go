@@ -2,15 +2,19 @@ package main
 
 import (
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/exec"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
+
+	"clive/internal/logging"
 )
 
 type ManagedProcess struct {
@@ -18,7 +22,10 @@ type ManagedProcess struct {
 	cmd *exec.Cmd
 }
 
-func (m *ManagedProcess) Start(logFile string, name string, args ...string) error {
+// Start runs name with args, logging its output to logFile. env is added to
+// the controller's own environment; secrets go there rather than in args,
+// which any local user can read with ps.
+func (m *ManagedProcess) Start(logFile string, env []string, name string, args ...string) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
@@ -28,6 +35,9 @@ func (m *ManagedProcess) Start(logFile string, name string, args ...string) erro
 
 	m.cmd = exec.Command(name, args...)
 	m.cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if len(env) > 0 {
+		m.cmd.Env = append(os.Environ(), env...)
+	}
 
 	var f *os.File
 	if logFile != "" {
@@ -37,7 +47,7 @@ func (m *ManagedProcess) Start(logFile string, name string, args ...string) erro
 			m.cmd.Stdout = io.MultiWriter(os.Stdout, f)
 			m.cmd.Stderr = io.MultiWriter(os.Stderr, f)
 		} else {
-			log.Printf("Failed to open log file %s: %v", logFile, err)
+			slog.Warn("Failed to open log file", "file", logFile, "err", err)
 			m.cmd.Stdout = os.Stdout
 			m.cmd.Stderr = os.Stderr
 		}
@@ -119,7 +129,12 @@ func statusHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 type SignalingConfig struct {
-	Addr string `json:"addr"`
+	Addr      string `json:"addr"`
+	AdminAddr string `json:"admin_addr"` // Admin API address, the server's default if empty
+	TLSCert   string `json:"tls_cert"`
+	TLSKey    string `json:"tls_key"`
+	LogFormat string `json:"log_format"` // "text" or "json"
+	LogLevel  string `json:"log_level"`  // "debug", "info", "warn" or "error"
 }
 
 func startSignalingHandler(w http.ResponseWriter, r *http.Request) {
@@ -134,13 +149,41 @@ func startSignalingHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Query params override JSON body
-	if v := r.URL.Query().Get("addr"); v != "" {
+	q := r.URL.Query()
+	if v := q.Get("addr"); v != "" {
 		config.Addr = v
 	}
+	if v := q.Get("admin_addr"); v != "" {
+		config.AdminAddr = v
+	}
+	if v := q.Get("tls_cert"); v != "" {
+		config.TLSCert = v
+	}
+	if v := q.Get("tls_key"); v != "" {
+		config.TLSKey = v
+	}
+	if v := q.Get("log_format"); v != "" {
+		config.LogFormat = v
+	}
+	if v := q.Get("log_level"); v != "" {
+		config.LogLevel = v
+	}
 
 	args := []string{"-addr", config.Addr}
+	if config.AdminAddr != "" {
+		args = append(args, "-admin-addr", config.AdminAddr)
+	}
+	if config.TLSCert != "" {
+		args = append(args, "-tls-cert", config.TLSCert, "-tls-key", config.TLSKey)
+	}
+	if config.LogFormat != "" {
+		args = append(args, "-log-format", config.LogFormat)
+	}
+	if config.LogLevel != "" {
+		args = append(args, "-log-level", config.LogLevel)
+	}
 
-	if err := signalingProc.Start("signaling.log", "./signaling-server", args...); err != nil {
+	if err := signalingProc.Start("signaling.log", nil, "./signaling-server", args...); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -166,9 +209,30 @@ func signalingLogsHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 type ClientConfig struct {
-	Room   string `json:"room"`
-	Server string `json:"server"`
-	Caller bool   `json:"caller"`
+	Room               string   `json:"room"`
+	Server             string   `json:"server"`
+	Caller             bool     `json:"caller"`
+	Token              string   `json:"token"`                // Signaling server access token
+	Scheme             string   `json:"scheme"`               // "ws" or "wss"
+	CACert             string   `json:"ca_cert"`              // CA bundle used to verify a wss:// server
+	InsecureSkipVerify bool     `json:"insecure_skip_verify"` // Skip wss:// certificate verification
+	Config             string   `json:"config"`               // Path to a clive-cli JSON config file
+	ICEServers         []string `json:"ice_servers"`          // Same syntax as clive-cli -ice-server
+	ICETransportPolicy string   `json:"ice_transport_policy"` // "all" or "relay"
+	LogFormat          string   `json:"log_format"`           // "text" or "json"
+	LogLevel           string   `json:"log_level"`            // "debug", "info", "warn" or "error"
+	Display            string   `json:"display"`              // "ffplay", "file" or "none" (headless)
+	VideoSource        string   `json:"video_source"`         // "camera", "testpattern", "none" or "file:<path.ivf>"
+	AudioSource        string   `json:"audio_source"`         // "mic", "tone", "none" or "file:<path.ogg>"
+	VideoCodec         string   `json:"video_codec"`          // Preferred codec: "vp8", "vp9", "h264" or "av1"
+	Width              int      `json:"width"`                // Video width in pixels
+	Height             int      `json:"height"`               // Video height in pixels
+	FPS                float64  `json:"fps"`                  // Video frame rate
+	VideoBitrate       int      `json:"video_bitrate"`        // Maximum bits per second
+	KeyframeInterval   int      `json:"keyframe_interval"`    // Frames between keyframes
+	AudioBitrate       int      `json:"audio_bitrate"`        // Opus bits per second
+	OpusFrame          string   `json:"opus_frame"`           // Opus frame duration, e.g. "20ms"
+	AudioChannels      int      `json:"audio_channels"`       // 1 or 2
 }
 
 func startClientHandler(w http.ResponseWriter, r *http.Request) {
@@ -192,6 +256,77 @@ func startClientHandler(w http.ResponseWriter, r *http.Request) {
 	if v := q.Get("caller"); v != "" {
 		config.Caller = v == "true" || v == "1"
 	}
+	if v := q.Get("token"); v != "" {
+		config.Token = v
+	}
+	if v := q.Get("scheme"); v != "" {
+		config.Scheme = v
+	}
+	if v := q.Get("ca_cert"); v != "" {
+		config.CACert = v
+	}
+	if v := q.Get("insecure_skip_verify"); v != "" {
+		config.InsecureSkipVerify = v == "true" || v == "1"
+	}
+	if v := q.Get("config"); v != "" {
+		config.Config = v
+	}
+	if v := q["ice_server"]; len(v) > 0 {
+		config.ICEServers = v
+	}
+	if v := q.Get("ice_transport_policy"); v != "" {
+		config.ICETransportPolicy = v
+	}
+	if v := q.Get("log_format"); v != "" {
+		config.LogFormat = v
+	}
+	if v := q.Get("log_level"); v != "" {
+		config.LogLevel = v
+	}
+	if v := q.Get("display"); v != "" {
+		config.Display = v
+	}
+	if v := q.Get("video_source"); v != "" {
+		config.VideoSource = v
+	}
+	if v := q.Get("audio_source"); v != "" {
+		config.AudioSource = v
+	}
+	if v := q.Get("video_codec"); v != "" {
+		config.VideoCodec = v
+	}
+	intParams := []struct {
+		name string
+		dst  *int
+	}{
+		{"width", &config.Width},
+		{"height", &config.Height},
+		{"video_bitrate", &config.VideoBitrate},
+		{"keyframe_interval", &config.KeyframeInterval},
+		{"audio_bitrate", &config.AudioBitrate},
+		{"audio_channels", &config.AudioChannels},
+	}
+	for _, p := range intParams {
+		if v := q.Get(p.name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid %s: %v", p.name, err), http.StatusBadRequest)
+				return
+			}
+			*p.dst = n
+		}
+	}
+	if v := q.Get("fps"); v != "" {
+		fps, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid fps: %v", err), http.StatusBadRequest)
+			return
+		}
+		config.FPS = fps
+	}
+	if v := q.Get("opus_frame"); v != "" {
+		config.OpusFrame = v
+	}
 
 	args := []string{
 		"-room", config.Room,
@@ -200,8 +335,74 @@ func startClientHandler(w http.ResponseWriter, r *http.Request) {
 	if config.Caller {
 		args = append(args, "-caller")
 	}
+	if config.Scheme != "" {
+		args = append(args, "-scheme", config.Scheme)
+	}
+	if config.CACert != "" {
+		args = append(args, "-ca-cert", config.CACert)
+	}
+	if config.InsecureSkipVerify {
+		args = append(args, "-insecure-skip-verify")
+	}
+	if config.Config != "" {
+		args = append(args, "-config", config.Config)
+	}
+	for _, server := range config.ICEServers {
+		args = append(args, "-ice-server", server)
+	}
+	if config.ICETransportPolicy != "" {
+		args = append(args, "-ice-transport-policy", config.ICETransportPolicy)
+	}
+	if config.LogFormat != "" {
+		args = append(args, "-log-format", config.LogFormat)
+	}
+	if config.LogLevel != "" {
+		args = append(args, "-log-level", config.LogLevel)
+	}
+	if config.Display != "" {
+		args = append(args, "-display", config.Display)
+	}
+	if config.VideoSource != "" {
+		args = append(args, "-video-source", config.VideoSource)
+	}
+	if config.AudioSource != "" {
+		args = append(args, "-audio-source", config.AudioSource)
+	}
+	if config.VideoCodec != "" {
+		args = append(args, "-video-codec", config.VideoCodec)
+	}
+	// clive-cli validates these against the devices it finds
+	if config.Width != 0 {
+		args = append(args, "-width", strconv.Itoa(config.Width))
+	}
+	if config.Height != 0 {
+		args = append(args, "-height", strconv.Itoa(config.Height))
+	}
+	if config.FPS != 0 {
+		args = append(args, "-fps", strconv.FormatFloat(config.FPS, 'g', -1, 64))
+	}
+	if config.VideoBitrate != 0 {
+		args = append(args, "-video-bitrate", strconv.Itoa(config.VideoBitrate))
+	}
+	if config.KeyframeInterval != 0 {
+		args = append(args, "-keyframe-interval", strconv.Itoa(config.KeyframeInterval))
+	}
+	if config.AudioBitrate != 0 {
+		args = append(args, "-audio-bitrate", strconv.Itoa(config.AudioBitrate))
+	}
+	if config.OpusFrame != "" {
+		args = append(args, "-opus-frame", config.OpusFrame)
+	}
+	if config.AudioChannels != 0 {
+		args = append(args, "-audio-channels", strconv.Itoa(config.AudioChannels))
+	}
 
-	if err := clientProc.Start("client.log", "./clive-cli", args...); err != nil {
+	var env []string
+	if config.Token != "" {
+		env = append(env, "CLIVE_TOKEN="+config.Token)
+	}
+
+	if err := clientProc.Start("client.log", env, "./clive-cli", args...); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -256,6 +457,20 @@ func pullHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func main() {
+	tlsCert := flag.String("tls-cert", "", "TLS certificate file; serves HTTPS when set together with -tls-key")
+	tlsKey := flag.String("tls-key", "", "TLS private key file")
+	logFormat := flag.String("log-format", "text", "Log format: text or json")
+	logLevel := flag.String("log-level", "info", "Minimum log level: debug, info, warn or error")
+	flag.Parse()
+
+	if err := logging.Setup(*logFormat, *logLevel); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if (*tlsCert == "") != (*tlsKey == "") {
+		logging.Fatal("-tls-cert and -tls-key must be set together")
+	}
+
 	http.HandleFunc("/status", statusHandler)
 	http.HandleFunc("/signaling/start", startSignalingHandler)
 	http.HandleFunc("/signaling/stop", stopSignalingHandler)
@@ -266,18 +481,25 @@ func main() {
 	http.HandleFunc("/pull", pullHandler)
 
 	port := "9090"
-	log.Printf("Control server listening on :%s\n", port)
-	log.Printf("Endpoints:\n")
-	log.Printf("  GET  /status\n")
-	log.Printf("  POST /signaling/start\n")
-	log.Printf("  POST /signaling/stop\n")
-	log.Printf("  GET  /signaling/logs\n")
-	log.Printf("  POST /client/start\n")
-	log.Printf("  POST /client/stop\n")
-	log.Printf("  GET  /client/logs\n")
-	log.Printf("  POST /pull\n")
-
-	if err := http.ListenAndServe(":"+port, nil); err != nil {
-		log.Fatalf("Failed to start server: %v", err)
+	slog.Info("Control server listening", "addr", ":"+port, "tls", *tlsCert != "",
+		"endpoints", []string{
+			"GET /status",
+			"POST /signaling/start",
+			"POST /signaling/stop",
+			"GET /signaling/logs",
+			"POST /client/start",
+			"POST /client/stop",
+			"GET /client/logs",
+			"POST /pull",
+		})
+
+	var err error
+	if *tlsCert != "" {
+		err = http.ListenAndServeTLS(":"+port, *tlsCert, *tlsKey, nil)
+	} else {
+		err = http.ListenAndServe(":"+port, nil)
+	}
+	if err != nil {
+		logging.Fatal("Failed to start server", "err", err)
 	}
 }
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// AdminPeerInfo describes a connected client to operators
+type AdminPeerInfo struct {
+	ID         string    `json:"id"`
+	Name       string    `json:"name,omitempty"`
+	Role       string    `json:"role"`
+	JoinedAt   time.Time `json:"joined_at"`
+	RemoteAddr string    `json:"remote_addr"`
+}
+
+// AdminRoomInfo describes a room to operators
+type AdminRoomInfo struct {
+	Name      string          `json:"name"`
+	CreatedAt time.Time       `json:"created_at"`
+	MaxPeers  int             `json:"max_peers"`
+	Peers     []AdminPeerInfo `json:"peers"`
+}
+
+// registerAdminHandlers adds the endpoints administering the rooms of inst
+// to mux
+func registerAdminHandlers(mux *http.ServeMux, inst *Instance) {
+	mux.HandleFunc("GET /rooms", requireAdmin(inst.listRoomsHandler))
+	mux.HandleFunc("GET /rooms/{name}", requireAdmin(inst.getRoomHandler))
+	mux.HandleFunc("DELETE /rooms/{name}", requireAdmin(inst.deleteRoomHandler))
+	mux.HandleFunc("POST /rooms/{name}/kick/{peer}", requireAdmin(inst.kickPeerHandler))
+}
+
+// isLoopbackAddr reports whether the listen address addr only accepts
+// connections from this host
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// requireAdmin only lets requests with an admin token through when
+// authentication is enabled
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if auth != nil {
+			token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok {
+				authError(w, errMissingToken)
+				return
+			}
+			claims, err := auth.Verify(token)
+			if err != nil {
+				authError(w, err)
+				return
+			}
+			if claims.Role != RoleAdmin {
+				http.Error(w, "admin role required", http.StatusForbidden)
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+// info returns the operator view of the room
+func (room *Room) info() AdminRoomInfo {
+	room.mu.Lock()
+	defer room.mu.Unlock()
+
+	info := AdminRoomInfo{
+		Name:      room.Name,
+		CreatedAt: room.CreatedAt,
+		MaxPeers:  room.MaxPeers,
+		Peers:     []AdminPeerInfo{},
+	}
+	for _, client := range room.Clients {
+		info.Peers = append(info.Peers, AdminPeerInfo{
+			ID:         client.ID,
+			Name:       client.Name,
+			Role:       client.Role,
+			JoinedAt:   client.JoinedAt,
+			RemoteAddr: client.RemoteAddr,
+		})
+	}
+	slices.SortFunc(info.Peers, func(a, b AdminPeerInfo) int {
+		return a.JoinedAt.Compare(b.JoinedAt)
+	})
+	return info
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func (inst *Instance) listRoomsHandler(w http.ResponseWriter, r *http.Request) {
+	inst.mu.Lock()
+	list := make([]*Room, 0, len(inst.rooms))
+	for _, room := range inst.rooms {
+		list = append(list, room)
+	}
+	inst.mu.Unlock()
+
+	infos := make([]AdminRoomInfo, 0, len(list))
+	for _, room := range list {
+		infos = append(infos, room.info())
+	}
+	slices.SortFunc(infos, func(a, b AdminRoomInfo) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	writeJSON(w, infos)
+}
+
+func (inst *Instance) getRoomHandler(w http.ResponseWriter, r *http.Request) {
+	room := inst.lookupRoom(r.PathValue("name"))
+	if room == nil {
+		http.Error(w, "room not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, room.info())
+}
+
+func (inst *Instance) deleteRoomHandler(w http.ResponseWriter, r *http.Request) {
+	room := inst.lookupRoom(r.PathValue("name"))
+	if room == nil {
+		http.Error(w, "room not found", http.StatusNotFound)
+		return
+	}
+	slog.Info("Admin closing room", "room", room.Name, "remote_addr", r.RemoteAddr)
+	inst.closeRoom(room, "room-closed", "room closed by an administrator")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (inst *Instance) kickPeerHandler(w http.ResponseWriter, r *http.Request) {
+	room := inst.lookupRoom(r.PathValue("name"))
+	if room == nil {
+		http.Error(w, "room not found", http.StatusNotFound)
+		return
+	}
+	peerID := r.PathValue("peer")
+
+	room.mu.Lock()
+	defer room.mu.Unlock()
+	client, ok := room.Clients[peerID]
+	if !ok {
+		http.Error(w, "peer not found", http.StatusNotFound)
+		return
+	}
+
+	slog.Info("Admin kicking peer", "room", room.Name, "peer_id", peerID, "remote_addr", r.RemoteAddr)
+	client.SendError("kicked", "removed from the room by an administrator")
+	// Closing the connection ends the client's read loop, which removes it
+	// from the room and notifies the other peers
+	client.Close(websocket.ClosePolicyViolation, "kicked")
+	w.WriteHeader(http.StatusNoContent)
+}
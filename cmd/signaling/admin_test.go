@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// startAdmin serves the admin API of inst and returns its base URL
+func startAdmin(t *testing.T, inst *Instance) string {
+	t.Helper()
+	mux := http.NewServeMux()
+	registerAdminHandlers(mux, inst)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+// adminRequest sends an admin API request with token, if set, and returns
+// the response, decoding its JSON body into v if v isn't nil
+func adminRequest(t *testing.T, method, url, token string, v any) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if v != nil && resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("%s %s: %v", method, url, err)
+		}
+	}
+	return resp
+}
+
+// expectClosed waits for the server to close p's connection after sending an
+// error with the given code
+func (p *testPeer) expectClosed(code string) {
+	p.t.Helper()
+	msg := p.expect("error", "")
+	var data ErrorData
+	json.Unmarshal(msg.Data, &data)
+	if data.Code != code {
+		p.t.Errorf("Error code %q, want %q", data.Code, code)
+	}
+	for {
+		if _, _, err := p.conn.ReadMessage(); err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.ClosePolicyViolation) {
+				p.t.Errorf("Waiting to be disconnected: %v", err)
+			}
+			return
+		}
+	}
+}
+
+func TestAdminAPI(t *testing.T) {
+	inst, wsURL := startInstance(t, NewMemoryBroker(), RoomLimits{EmptyGrace: time.Minute})
+	adminURL := startAdmin(t, inst)
+	alice := joinPeer(t, wsURL, "call")
+	bob := joinPeer(t, wsURL, "call")
+	carol := joinPeer(t, wsURL, "other")
+	alice.expect("peer-joined", bob.ID)
+
+	var rooms []AdminRoomInfo
+	if resp := adminRequest(t, "GET", adminURL+"/rooms", "", &rooms); resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /rooms: %s", resp.Status)
+	}
+	if len(rooms) != 2 || rooms[0].Name != "call" || len(rooms[0].Peers) != 2 || rooms[1].Name != "other" || len(rooms[1].Peers) != 1 {
+		t.Errorf("GET /rooms = %+v, want call with 2 peers and other with 1", rooms)
+	}
+
+	var room AdminRoomInfo
+	if resp := adminRequest(t, "GET", adminURL+"/rooms/call", "", &room); resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /rooms/call: %s", resp.Status)
+	}
+	if len(room.Peers) != 2 || room.Peers[0].ID != alice.ID || room.Peers[1].ID != bob.ID || room.Peers[0].RemoteAddr == "" {
+		t.Errorf("GET /rooms/call = %+v, want alice then bob", room)
+	}
+
+	for _, tt := range []struct {
+		method, path string
+	}{
+		{"GET", "/rooms/nowhere"},
+		{"DELETE", "/rooms/nowhere"},
+		{"POST", "/rooms/nowhere/kick/" + alice.ID},
+		{"POST", "/rooms/call/kick/" + carol.ID},
+	} {
+		if resp := adminRequest(t, tt.method, adminURL+tt.path, "", nil); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("%s %s: %s, want 404", tt.method, tt.path, resp.Status)
+		}
+	}
+
+	if resp := adminRequest(t, "POST", adminURL+"/rooms/call/kick/"+bob.ID, "", nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Kick: %s", resp.Status)
+	}
+	bob.expectClosed("kicked")
+	alice.expect("peer-left", bob.ID)
+
+	if resp := adminRequest(t, "DELETE", adminURL+"/rooms/call", "", nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("DELETE: %s", resp.Status)
+	}
+	alice.expectClosed("room-closed")
+	if resp := adminRequest(t, "GET", adminURL+"/rooms/call", "", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET a deleted room: %s, want 404", resp.Status)
+	}
+	if resp := adminRequest(t, "GET", adminURL+"/rooms", "", &rooms); resp.StatusCode != http.StatusOK || len(rooms) != 1 {
+		t.Errorf("GET /rooms after deleting one: %s %+v, want other only", resp.Status, rooms)
+	}
+}
+
+func TestAdminRequiresAdminToken(t *testing.T) {
+	oldAuth := auth
+	auth = NewAuthenticator("secret")
+	t.Cleanup(func() { auth = oldAuth })
+
+	token := func(a *Authenticator, claims Claims) string {
+		token, err := a.Issue(claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	inst := NewInstance(NewMemoryBroker(), RoomLimits{EmptyGrace: time.Minute})
+	t.Cleanup(inst.Close)
+	adminURL := startAdmin(t, inst)
+
+	for _, tt := range []struct {
+		name   string
+		token  string
+		status int
+	}{
+		{"no token", "", http.StatusUnauthorized},
+		{"garbage", "nonsense", http.StatusUnauthorized},
+		{"other secret", token(NewAuthenticator("other"), Claims{Room: "*", Role: RoleAdmin}), http.StatusUnauthorized},
+		{"expired", token(auth, Claims{Room: "*", Role: RoleAdmin, ExpiresAt: time.Now().Add(-time.Minute).Unix()}), http.StatusUnauthorized},
+		{"peer", token(auth, Claims{Room: "*", Role: RolePeer}), http.StatusForbidden},
+		{"admin", token(auth, Claims{Role: RoleAdmin}), http.StatusOK},
+	} {
+		resp := adminRequest(t, "GET", adminURL+"/rooms", tt.token, nil)
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s: %s, want %d", tt.name, resp.Status, tt.status)
+		}
+	}
+
+	// Rejected before the handler runs
+	inst.getOrCreateRoom("call", 0)
+	resp := adminRequest(t, "DELETE", adminURL+"/rooms/call", token(auth, Claims{Room: "call", Role: RolePeer}), nil)
+	if resp.StatusCode != http.StatusForbidden || inst.lookupRoom("call") == nil {
+		t.Errorf("DELETE with a peer token: %s, want 403 and the room kept", resp.Status)
+	}
+}
+
+func TestIsLoopbackAddr(t *testing.T) {
+	for addr, want := range map[string]bool{
+		"localhost:8079": true,
+		"127.0.0.1:8079": true,
+		"[::1]:8079":     true,
+		":8079":          false,
+		"0.0.0.0:8079":   false,
+		"10.0.0.1:8079":  false,
+		"localhost":      false,
+	} {
+		if got := isLoopbackAddr(addr); got != want {
+			t.Errorf("isLoopbackAddr(%q) = %v, want %v", addr, got, want)
+		}
+	}
+}
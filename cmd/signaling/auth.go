@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Roles a token can grant
+const (
+	RolePeer  = "peer"  // May join the room named in the token
+	RoleAdmin = "admin" // May join any room
+)
+
+var (
+	errMissingToken = errors.New("missing token")
+	errInvalidToken = errors.New("invalid token")
+	errTokenExpired = errors.New("token expired")
+	errWrongRoom    = errors.New("token not valid for this room")
+)
+
+// Claims is the payload of a signaling token
+type Claims struct {
+	Room      string `json:"room,omitempty"` // Room the token grants access to; "*" for any
+	Role      string `json:"role"`
+	Subject   string `json:"sub,omitempty"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp,omitempty"`
+}
+
+// tokenHeader is the fixed JWT header; only HS256 is accepted
+var tokenHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// Authenticator issues and validates HMAC-SHA256 signed JWT-style tokens
+type Authenticator struct {
+	secret []byte
+}
+
+// NewAuthenticator returns an Authenticator using secret, or nil when secret
+// is empty and authentication is disabled
+func NewAuthenticator(secret string) *Authenticator {
+	if secret == "" {
+		return nil
+	}
+	return &Authenticator{secret: []byte(secret)}
+}
+
+func (a *Authenticator) sign(signingInput string) string {
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte(signingInput))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Issue creates a token for claims
+func (a *Authenticator) Issue(claims Claims) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := tokenHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signingInput + "." + a.sign(signingInput), nil
+}
+
+// Verify checks the token signature and expiry and returns its claims
+func (a *Authenticator) Verify(token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errInvalidToken
+	}
+
+	header, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errInvalidToken
+	}
+	var h struct {
+		Alg string `json:"alg"`
+	}
+	if err := json.Unmarshal(header, &h); err != nil || h.Alg != "HS256" {
+		return nil, errInvalidToken
+	}
+
+	expected := a.sign(parts[0] + "." + parts[1])
+	if !hmac.Equal([]byte(expected), []byte(parts[2])) {
+		return nil, errInvalidToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errInvalidToken
+	}
+	var claims Claims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, errInvalidToken
+	}
+	if claims.ExpiresAt != 0 && time.Now().Unix() >= claims.ExpiresAt {
+		return nil, errTokenExpired
+	}
+	if claims.Role != RolePeer && claims.Role != RoleAdmin {
+		return nil, errInvalidToken
+	}
+	return &claims, nil
+}
+
+// Authorize validates the token carried by r for roomName. The token is read
+// from an "Authorization: Bearer" header, or from the "token" query parameter
+// for clients that cannot set headers on a WebSocket handshake.
+func (a *Authenticator) Authorize(r *http.Request, roomName string) (*Claims, error) {
+	token := r.URL.Query().Get("token")
+	if h := r.Header.Get("Authorization"); h != "" {
+		var ok bool
+		if token, ok = strings.CutPrefix(h, "Bearer "); !ok {
+			return nil, errInvalidToken
+		}
+	}
+	if token == "" {
+		return nil, errMissingToken
+	}
+
+	claims, err := a.Verify(token)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Role != RoleAdmin && claims.Room != "*" && claims.Room != roomName {
+		return nil, errWrongRoom
+	}
+	return claims, nil
+}
+
+// authError writes the HTTP response for a rejected handshake
+func authError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errWrongRoom) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	w.Header().Set("WWW-Authenticate", `Bearer realm="clive"`)
+	http.Error(w, err.Error(), http.StatusUnauthorized)
+}
+
+// issueToken prints a token for the given claims, for use by operators
+func issueToken(auth *Authenticator, room, role string, ttl time.Duration) error {
+	if auth == nil {
+		return fmt.Errorf("-issue-token requires -auth-secret or CLIVE_AUTH_SECRET")
+	}
+	if role != RolePeer && role != RoleAdmin {
+		return fmt.Errorf("invalid role %q (want %s or %s)", role, RolePeer, RoleAdmin)
+	}
+
+	now := time.Now()
+	claims := Claims{Room: room, Role: role, IssuedAt: now.Unix()}
+	if ttl > 0 {
+		claims.ExpiresAt = now.Add(ttl).Unix()
+	}
+	token, err := auth.Issue(claims)
+	if err != nil {
+		return err
+	}
+	fmt.Println(token)
+	return nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// forgeToken returns a token with the given raw header and claims, signed by
+// a unless sign is false
+func forgeToken(a *Authenticator, header, claims string, sign bool) string {
+	input := base64.RawURLEncoding.EncodeToString([]byte(header)) + "." +
+		base64.RawURLEncoding.EncodeToString([]byte(claims))
+	if !sign {
+		return input + "."
+	}
+	return input + "." + a.sign(input)
+}
+
+func TestVerify(t *testing.T) {
+	a := NewAuthenticator("secret")
+	issue := func(claims Claims) string {
+		token, err := a.Issue(claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	valid := issue(Claims{Room: "room", Role: RolePeer})
+	parts := strings.Split(valid, ".")
+
+	for _, tt := range []struct {
+		name  string
+		token string
+		err   error
+	}{
+		{"valid", valid, nil},
+		{"valid until later", issue(Claims{Role: RolePeer, ExpiresAt: time.Now().Add(time.Hour).Unix()}), nil},
+		{"expired", issue(Claims{Role: RolePeer, ExpiresAt: time.Now().Add(-time.Second).Unix()}), errTokenExpired},
+		{"tampered signature", parts[0] + "." + parts[1] + "." + strings.Repeat("A", len(parts[2])), errInvalidToken},
+		{"tampered claims", parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"room":"*","role":"admin"}`)) + "." + parts[2], errInvalidToken},
+		{"signed with another secret", parts[0] + "." + parts[1] + "." + NewAuthenticator("other").sign(parts[0]+"."+parts[1]), errInvalidToken},
+		{"alg none", forgeToken(a, `{"alg":"none","typ":"JWT"}`, `{"role":"admin"}`, false), errInvalidToken},
+		{"alg none signed", forgeToken(a, `{"alg":"none","typ":"JWT"}`, `{"role":"admin"}`, true), errInvalidToken},
+		{"alg HS512", forgeToken(a, `{"alg":"HS512","typ":"JWT"}`, `{"role":"peer"}`, true), errInvalidToken},
+		{"alg missing", forgeToken(a, `{"typ":"JWT"}`, `{"role":"peer"}`, true), errInvalidToken},
+		{"unknown role", issue(Claims{Role: "owner"}), errInvalidToken},
+		{"no role", issue(Claims{Room: "room"}), errInvalidToken},
+		{"claims not JSON", forgeToken(a, `{"alg":"HS256","typ":"JWT"}`, `role=admin`, true), errInvalidToken},
+		{"two parts", parts[0] + "." + parts[1], errInvalidToken},
+		{"empty", "", errInvalidToken},
+	} {
+		claims, err := a.Verify(tt.token)
+		if !errors.Is(err, tt.err) || (err == nil) != (claims != nil) {
+			t.Errorf("%s: %v, %v, want error %v", tt.name, claims, err, tt.err)
+		}
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	a := NewAuthenticator("secret")
+	token := func(room, role string) string {
+		token, err := a.Issue(Claims{Room: room, Role: role})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	for _, tt := range []struct {
+		name   string
+		header string // Authorization header
+		query  string // token query parameter
+		room   string
+		role   string // Role granted, if the token is accepted
+		err    error
+	}{
+		{name: "peer in its room", header: "Bearer " + token("call", RolePeer), room: "call", role: RolePeer},
+		{name: "peer in another room", header: "Bearer " + token("call", RolePeer), room: "other", err: errWrongRoom},
+		{name: "peer in any room", header: "Bearer " + token("*", RolePeer), room: "other", role: RolePeer},
+		{name: "admin in another room", header: "Bearer " + token("call", RoleAdmin), room: "other", role: RoleAdmin},
+		{name: "token in the query", query: token("call", RolePeer), room: "call", role: RolePeer},
+		{name: "query token for another room", query: token("call", RolePeer), room: "other", err: errWrongRoom},
+		{name: "header wins over the query", header: "Bearer " + token("other", RolePeer), query: token("call", RolePeer), room: "call", err: errWrongRoom},
+		{name: "not a bearer token", header: "Basic dXNlcjpwYXNz", room: "call", err: errInvalidToken},
+		{name: "no token", room: "call", err: errMissingToken},
+		{name: "garbage", header: "Bearer nonsense", room: "call", err: errInvalidToken},
+	} {
+		r := httptest.NewRequest("GET", "/ws?token="+tt.query, nil)
+		if tt.header != "" {
+			r.Header.Set("Authorization", tt.header)
+		}
+		claims, err := a.Authorize(r, tt.room)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: %v, want %v", tt.name, err, tt.err)
+			continue
+		}
+		if err == nil && claims.Role != tt.role {
+			t.Errorf("%s: role %q, want %q", tt.name, claims.Role, tt.role)
+		}
+	}
+}
+
+func TestAuthError(t *testing.T) {
+	for _, tt := range []struct {
+		err    error
+		status int
+	}{
+		{errMissingToken, 401},
+		{errInvalidToken, 401},
+		{errTokenExpired, 401},
+		{errWrongRoom, 403},
+	} {
+		w := httptest.NewRecorder()
+		authError(w, tt.err)
+		if w.Code != tt.status {
+			t.Errorf("%v: status %d, want %d", tt.err, w.Code, tt.status)
+		}
+		if challenge := w.Header().Get("WWW-Authenticate"); (challenge != "") != (tt.status == 401) {
+			t.Errorf("%v: WWW-Authenticate %q", tt.err, challenge)
+		}
+	}
+}
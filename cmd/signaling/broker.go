@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// brokerQueueSize is how many envelopes may wait for delivery per subscriber
+// (memory) or for publishing (Redis) before new ones are dropped
+const brokerQueueSize = 256
+
+// brokerPublishTimeout is how long publishing an offer or an answer waits for
+// room in a full queue before giving up
+var brokerPublishTimeout = time.Second
+
+var errBrokerBusy = errors.New("broker queue full")
+
+// Envelope carries a room message between signaling instances
+type Envelope struct {
+	Instance   string  `json:"instance"`              // ID of the publishing instance
+	ToInstance string  `json:"to_instance,omitempty"` // Only this instance handles it, empty for all
+	Msg        Message `json:"msg"`
+}
+
+// Broker fans room messages out to every signaling instance serving the
+// room, so peers connected to different instances can reach each other.
+// Publish is called with the room lock held, so it only blocks when a queue
+// is full and env is an offer or an answer, and then for no longer than
+// brokerPublishTimeout. Subscribe and unsubscribe may wait on the network and
+// are called without any lock.
+type Broker interface {
+	// Publish sends env to every subscriber of room, including the publisher
+	Publish(room string, env Envelope) error
+	// Subscribe calls handle for every envelope published to room until
+	// unsubscribe is called. handle runs on a broker goroutine.
+	Subscribe(room string, handle func(Envelope)) (unsubscribe func(), err error)
+}
+
+// newBroker creates the broker described by spec: "memory" for a single
+// instance, or a redis:// or rediss:// URL
+func newBroker(spec string) (Broker, error) {
+	switch {
+	case spec == "" || spec == "memory":
+		return NewMemoryBroker(), nil
+	case strings.HasPrefix(spec, "redis://"), strings.HasPrefix(spec, "rediss://"):
+		return NewRedisBroker(spec)
+	default:
+		return nil, fmt.Errorf("unsupported broker %q (want memory or a redis:// URL)", spec)
+	}
+}
+
+// MemoryBroker delivers envelopes within the current process. It is what a
+// single signaling instance uses; several Instances sharing one stand in for
+// a Redis deployment in tests.
+type MemoryBroker struct {
+	mu   sync.Mutex
+	subs map[string]map[*memorySubscription]struct{}
+}
+
+type memorySubscription struct {
+	queue chan Envelope
+	done  chan struct{}
+}
+
+// NewMemoryBroker creates an empty in-process broker
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{subs: make(map[string]map[*memorySubscription]struct{})}
+}
+
+// Publish queues env for every subscriber of room. Other envelopes are
+// dropped for a subscriber that has fallen behind, offers and answers wait
+// for it.
+func (b *MemoryBroker) Publish(room string, env Envelope) error {
+	b.mu.Lock()
+	subs := make([]*memorySubscription, 0, len(b.subs[room]))
+	for sub := range b.subs[room] {
+		subs = append(subs, sub)
+	}
+	b.mu.Unlock()
+
+	var err error
+	for _, sub := range subs {
+		select {
+		case sub.queue <- env:
+			continue
+		case <-sub.done:
+			continue
+		default:
+		}
+		if !undroppableMessages[env.Msg.Type] {
+			err = errBrokerBusy
+			continue
+		}
+		timer := time.NewTimer(brokerPublishTimeout)
+		select {
+		case sub.queue <- env:
+		case <-sub.done:
+		case <-timer.C:
+			err = errBrokerBusy
+		}
+		timer.Stop()
+	}
+	return err
+}
+
+// Subscribe starts delivering envelopes for room to handle
+func (b *MemoryBroker) Subscribe(room string, handle func(Envelope)) (func(), error) {
+	sub := &memorySubscription{
+		queue: make(chan Envelope, brokerQueueSize),
+		done:  make(chan struct{}),
+	}
+	go func() {
+		for {
+			select {
+			case env := <-sub.queue:
+				handle(env)
+			case <-sub.done:
+				return
+			}
+		}
+	}()
+
+	b.mu.Lock()
+	if b.subs[room] == nil {
+		b.subs[room] = make(map[*memorySubscription]struct{})
+	}
+	b.subs[room][sub] = struct{}{}
+	b.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subs[room], sub)
+			if len(b.subs[room]) == 0 {
+				delete(b.subs, room)
+			}
+			b.mu.Unlock()
+			close(sub.done)
+		})
+	}, nil
+}
+
+// RedisBroker exchanges envelopes through Redis pub/sub, one channel per
+// room. Publishing happens on a background goroutine so a slow Redis never
+// stalls a room.
+type RedisBroker struct {
+	client *redis.Client
+	pubsub *redis.PubSub
+	outbox chan redisPublication
+
+	mu       sync.Mutex
+	handlers map[string]*redisSubscription // Redis channel -> room subscription
+
+	// Held while talking to Redis about subscriptions, so SUBSCRIBE and
+	// UNSUBSCRIBE reach it in the order handlers changed
+	subMu sync.Mutex
+}
+
+type redisSubscription struct {
+	handle func(Envelope)
+}
+
+type redisPublication struct {
+	channel string
+	payload []byte
+}
+
+// NewRedisBroker connects to the Redis server at url (e.g.
+// redis://:password@host:6379/0)
+func NewRedisBroker(url string) (*RedisBroker, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse Redis URL: %w", err)
+	}
+	client := redis.NewClient(opts)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failed to connect to Redis: %w", err)
+	}
+
+	b := &RedisBroker{
+		client:   client,
+		pubsub:   client.Subscribe(context.Background()),
+		outbox:   make(chan redisPublication, brokerQueueSize),
+		handlers: make(map[string]*redisSubscription),
+	}
+	go b.publishLoop()
+	go b.receiveLoop()
+	return b, nil
+}
+
+func redisChannel(room string) string {
+	return "clive:room:" + room
+}
+
+// Publish queues env for publishing on the room's channel. Other envelopes
+// are dropped while the outbox is full, offers and answers wait for it.
+func (b *RedisBroker) Publish(room string, env Envelope) error {
+	payload, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+	pub := redisPublication{channel: redisChannel(room), payload: payload}
+	select {
+	case b.outbox <- pub:
+		return nil
+	default:
+	}
+	if !undroppableMessages[env.Msg.Type] {
+		return errBrokerBusy
+	}
+	timer := time.NewTimer(brokerPublishTimeout)
+	defer timer.Stop()
+	select {
+	case b.outbox <- pub:
+		return nil
+	case <-timer.C:
+		return errBrokerBusy
+	}
+}
+
+// Subscribe listens on the room's channel, replacing any earlier
+// subscription to it. The subscription survives Redis reconnects.
+func (b *RedisBroker) Subscribe(room string, handle func(Envelope)) (func(), error) {
+	channel := redisChannel(room)
+	sub := &redisSubscription{handle: handle}
+	b.subMu.Lock()
+	defer b.subMu.Unlock()
+	b.mu.Lock()
+	b.handlers[channel] = sub
+	b.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := b.pubsub.Subscribe(ctx, channel); err != nil {
+		b.mu.Lock()
+		delete(b.handlers, channel)
+		b.mu.Unlock()
+		return nil, fmt.Errorf("failed to subscribe to %s: %w", channel, err)
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			b.subMu.Lock()
+			defer b.subMu.Unlock()
+			b.mu.Lock()
+			current := b.handlers[channel] == sub
+			if current {
+				delete(b.handlers, channel)
+			}
+			b.mu.Unlock()
+			if !current {
+				return // The room was recreated and subscribed again
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := b.pubsub.Unsubscribe(ctx, channel); err != nil {
+				slog.Warn("Failed to unsubscribe from Redis channel", "channel", channel, "err", err)
+			}
+		})
+	}, nil
+}
+
+func (b *RedisBroker) publishLoop() {
+	for pub := range b.outbox {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := b.client.Publish(ctx, pub.channel, pub.payload).Err(); err != nil {
+			slog.Warn("Failed to publish to Redis channel", "channel", pub.channel, "err", err)
+		}
+		cancel()
+	}
+}
+
+func (b *RedisBroker) receiveLoop() {
+	for m := range b.pubsub.Channel(redis.WithChannelSize(brokerQueueSize)) {
+		b.mu.Lock()
+		sub := b.handlers[m.Channel]
+		b.mu.Unlock()
+		if sub == nil {
+			continue
+		}
+
+		var env Envelope
+		if err := json.Unmarshal([]byte(m.Payload), &env); err != nil {
+			slog.Warn("Invalid envelope", "channel", m.Channel, "err", err)
+			continue
+		}
+		sub.handle(env)
+	}
+}
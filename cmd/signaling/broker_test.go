@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// newTestRedisBroker connects a RedisBroker to srv for the rest of the test
+func newTestRedisBroker(t *testing.T, srv *miniredis.Miniredis) *RedisBroker {
+	t.Helper()
+	b, err := NewRedisBroker("redis://" + srv.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		b.pubsub.Close()
+		b.client.Close()
+	})
+	return b
+}
+
+// waitSubscribed waits until n connections to srv subscribe to room's
+// channel. Subscribe returns before Redis has seen the SUBSCRIBE, and an
+// envelope published before then would be lost.
+func waitSubscribed(t *testing.T, srv *miniredis.Miniredis, room string, n int) {
+	t.Helper()
+	channel := redisChannel(room)
+	deadline := time.Now().Add(time.Second)
+	for srv.PubSubNumSub(channel)[channel] != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d subscribers to %s, want %d", srv.PubSubNumSub(channel)[channel], channel, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// expectEnvelope waits for the next envelope a subscription receives
+func expectEnvelope(t *testing.T, received <-chan Envelope) Envelope {
+	t.Helper()
+	select {
+	case env := <-received:
+		return env
+	case <-time.After(time.Second):
+		t.Fatal("No envelope received")
+		return Envelope{}
+	}
+}
+
+// expectNoEnvelope checks a subscription receives nothing for a while
+func expectNoEnvelope(t *testing.T, received <-chan Envelope) {
+	t.Helper()
+	select {
+	case env := <-received:
+		t.Fatalf("Received %+v, want nothing", env)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestRedisBroker(t *testing.T) {
+	srv := miniredis.RunT(t)
+	b1 := newTestRedisBroker(t, srv)
+	b2 := newTestRedisBroker(t, srv)
+
+	subscribe := func(b *RedisBroker, room string) (<-chan Envelope, func()) {
+		received := make(chan Envelope, 10)
+		unsubscribe, err := b.Subscribe(room, func(env Envelope) { received <- env })
+		if err != nil {
+			t.Fatal(err)
+		}
+		return received, unsubscribe
+	}
+	got1, _ := subscribe(b1, "call")
+	got2, unsubscribe2 := subscribe(b2, "call")
+	other, _ := subscribe(b2, "other")
+	waitSubscribed(t, srv, "call", 2)
+	waitSubscribed(t, srv, "other", 1)
+
+	// Every subscriber gets the envelope, the publisher included, as it was
+	// sent
+	env := Envelope{
+		Instance:   "one",
+		ToInstance: "two",
+		Msg:        Message{Type: "offer", From: "alice", To: "bob", Data: json.RawMessage(`{"type":"offer","sdp":"v=0"}`)},
+	}
+	if err := b1.Publish("call", env); err != nil {
+		t.Fatal(err)
+	}
+	for _, received := range []<-chan Envelope{got1, got2} {
+		if got := expectEnvelope(t, received); !reflect.DeepEqual(got, env) {
+			t.Errorf("Received %+v, want %+v", got, env)
+		}
+	}
+	expectNoEnvelope(t, other)
+
+	unsubscribe2()
+	waitSubscribed(t, srv, "call", 1)
+	if err := b1.Publish("call", Envelope{Instance: "one", Msg: Message{Type: "candidate"}}); err != nil {
+		t.Fatal(err)
+	}
+	expectEnvelope(t, got1)
+	expectNoEnvelope(t, got2)
+
+	// Envelopes that don't decode are skipped
+	srv.Publish(redisChannel("call"), "not json")
+	expectNoEnvelope(t, got1)
+}
+
+func TestRedisBrokerResubscribe(t *testing.T) {
+	srv := miniredis.RunT(t)
+	b := newTestRedisBroker(t, srv)
+
+	old := make(chan Envelope, 10)
+	unsubscribeOld, err := b.Subscribe("call", func(env Envelope) { old <- env })
+	if err != nil {
+		t.Fatal(err)
+	}
+	current := make(chan Envelope, 10)
+	if _, err := b.Subscribe("call", func(env Envelope) { current <- env }); err != nil {
+		t.Fatal(err)
+	}
+
+	// A room recreated before the old one unsubscribed keeps its
+	// subscription
+	waitSubscribed(t, srv, "call", 1)
+	unsubscribeOld()
+	if err := b.Publish("call", Envelope{Instance: "one", Msg: Message{Type: "candidate"}}); err != nil {
+		t.Fatal(err)
+	}
+	expectEnvelope(t, current)
+	expectNoEnvelope(t, old)
+}
+
+func TestTwoInstancesShareRoomOverRedis(t *testing.T) {
+	srv := miniredis.RunT(t)
+	_, url1 := startInstance(t, newTestRedisBroker(t, srv), RoomLimits{EmptyGrace: time.Minute})
+	_, url2 := startInstance(t, newTestRedisBroker(t, srv), RoomLimits{EmptyGrace: time.Minute})
+
+	alice := joinPeer(t, url1, "shared")
+	waitSubscribed(t, srv, "shared", 1)
+	bob := joinPeer(t, url2, "shared")
+	alice.expect("peer-joined", bob.ID)
+	bob.expectPeer(alice.ID)
+
+	bob.send(Message{Type: "offer", To: alice.ID, Data: json.RawMessage(`{"type":"offer","sdp":"v=0"}`)})
+	alice.expect("offer", bob.ID)
+	alice.send(Message{Type: "answer", To: bob.ID, Data: json.RawMessage(`{"type":"answer","sdp":"v=0"}`)})
+	bob.expect("answer", alice.ID)
+
+	bob.conn.Close()
+	alice.expect("peer-left", bob.ID)
+}
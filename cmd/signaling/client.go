@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// What to do with a client whose outbound queue is full
+const (
+	SlowClientDrop       = "drop"       // Drop the message and keep the client
+	SlowClientDisconnect = "disconnect" // Disconnect the client
+)
+
+// writeTimeout bounds how long a single frame write may take
+const writeTimeout = 10 * time.Second
+
+var errQueueFull = errors.New("outbound queue full")
+
+// Outbound queue settings, set from flags
+var (
+	sendQueueSize    = 64
+	slowClientPolicy = SlowClientDisconnect
+)
+
+// Messages that are never dropped, whatever the policy: losing one leaves
+// the pair's negotiation stuck, while a disconnected client rejoins and
+// renegotiates
+var undroppableMessages = map[string]bool{
+	"offer":  true,
+	"answer": true,
+}
+
+// Client is a single WebSocket connection in a room, identified by a
+// server-assigned peer ID. Messages to the client are queued and written by
+// its own goroutine, so a slow client never blocks the rest of the room.
+type Client struct {
+	ID         string
+	Name       string
+	Role       string
+	JoinedAt   time.Time
+	RemoteAddr string
+	Conn       *websocket.Conn
+
+	out       chan outbound
+	closing   chan struct{} // Closed to make the writer flush and close the connection
+	closeOnce sync.Once
+	closeMsg  []byte // Close frame sent after the queue is flushed
+}
+
+// outbound is a message waiting in a client's queue
+type outbound struct {
+	payload  []byte
+	queuedAt time.Time
+}
+
+// NewClient wraps conn and starts its writer goroutine
+func NewClient(id string, conn *websocket.Conn) *Client {
+	c := &Client{
+		ID:      id,
+		Conn:    conn,
+		out:     make(chan outbound, sendQueueSize),
+		closing: make(chan struct{}),
+	}
+	go c.writeLoop()
+	return c
+}
+
+// Info returns the metadata other clients see for c
+func (c *Client) Info() PeerInfo {
+	return PeerInfo{ID: c.ID, Name: c.Name, Role: c.Role, JoinedAt: c.JoinedAt}
+}
+
+// Send queues msg for delivery without blocking. If the queue is full the
+// message is dropped, and with the disconnect policy, or if msg is an offer
+// or an answer, the client is closed.
+func (c *Client) Send(msg Message) error {
+	msgBytes, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-c.closing:
+		return websocket.ErrCloseSent
+	default:
+	}
+
+	select {
+	case c.out <- outbound{payload: msgBytes, queuedAt: time.Now()}:
+		return nil
+	default:
+	}
+
+	if slowClientPolicy == SlowClientDisconnect || undroppableMessages[msg.Type] {
+		slog.Warn("Peer too slow, disconnecting it", "peer_id", c.ID, "queued", cap(c.out))
+		c.Close(websocket.ClosePolicyViolation, "client too slow")
+	}
+	return fmt.Errorf("%w: dropped %s for peer %s", errQueueFull, msg.Type, c.ID)
+}
+
+// SendError queues an "error" message with the given code
+func (c *Client) SendError(code, message string) error {
+	errData, _ := json.Marshal(ErrorData{Code: code, Message: message})
+	return c.Send(Message{Type: "error", To: c.ID, Data: errData})
+}
+
+// Close makes the writer deliver whatever is still queued, send a close frame
+// with code and reason, and close the connection. It is safe to call more
+// than once; only the first call has an effect.
+func (c *Client) Close(code int, reason string) {
+	c.closeOnce.Do(func() {
+		c.closeMsg = websocket.FormatCloseMessage(code, reason)
+		close(c.closing)
+	})
+}
+
+// writeLoop is the only place data frames are written to the connection
+func (c *Client) writeLoop() {
+	defer c.Conn.Close()
+
+	for {
+		select {
+		case msg := <-c.out:
+			if err := c.write(msg); err != nil {
+				slog.Warn("Write error", "peer_id", c.ID, "err", err)
+				return
+			}
+		case <-c.closing:
+			for {
+				select {
+				case msg := <-c.out:
+					if err := c.write(msg); err != nil {
+						return
+					}
+				default:
+					c.Conn.WriteControl(websocket.CloseMessage, c.closeMsg, time.Now().Add(time.Second))
+					return
+				}
+			}
+		}
+	}
+}
+
+func (c *Client) write(msg outbound) error {
+	c.Conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if err := c.Conn.WriteMessage(websocket.TextMessage, msg.payload); err != nil {
+		writeErrors.Inc()
+		return err
+	}
+	relayLatency.Observe(time.Since(msg.queuedAt).Seconds())
+	return nil
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// idleClient returns a client with a queue of size whose writer isn't
+// running, so whatever is queued stays there
+func idleClient(size int) *Client {
+	return &Client{
+		ID:      "slow",
+		out:     make(chan outbound, size),
+		closing: make(chan struct{}),
+	}
+}
+
+func isClosing(c *Client) bool {
+	select {
+	case <-c.closing:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestClientQueueFlushedBeforeClose(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		c := NewClient("peer", conn)
+		for _, typ := range []string{"welcome", "roster", "peer-joined"} {
+			if err := c.Send(Message{Type: typ, To: c.ID}); err != nil {
+				t.Error(err)
+			}
+		}
+		c.Close(websocket.CloseNormalClosure, "bye")
+	}))
+	defer srv.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	for _, want := range []string{"welcome", "roster", "peer-joined"} {
+		var msg Message
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatalf("Waiting for %s: %v", want, err)
+		}
+		if msg.Type != want {
+			t.Errorf("Got %s, want %s", msg.Type, want)
+		}
+	}
+	_, _, err = conn.ReadMessage()
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != websocket.CloseNormalClosure || closeErr.Text != "bye" {
+		t.Errorf("After the queued messages: %v, want a normal close saying bye", err)
+	}
+}
+
+func TestSlowClient(t *testing.T) {
+	for _, tt := range []struct {
+		policy     string
+		typ        string
+		disconnect bool
+	}{
+		{SlowClientDisconnect, "candidate", true},
+		{SlowClientDisconnect, "offer", true},
+		{SlowClientDrop, "candidate", false},
+		{SlowClientDrop, "peer-joined", false},
+		{SlowClientDrop, "offer", true},
+		{SlowClientDrop, "answer", true},
+	} {
+		t.Run(tt.policy+"/"+tt.typ, func(t *testing.T) {
+			oldPolicy := slowClientPolicy
+			slowClientPolicy = tt.policy
+			t.Cleanup(func() { slowClientPolicy = oldPolicy })
+
+			c := idleClient(2)
+			for range cap(c.out) {
+				if err := c.Send(Message{Type: "candidate"}); err != nil {
+					t.Fatalf("Send with room in the queue: %v", err)
+				}
+			}
+			if isClosing(c) {
+				t.Fatal("Client closed before its queue filled up")
+			}
+
+			data, _ := json.Marshal(sessionDescription{Type: tt.typ, SDP: "v=0"})
+			if err := c.Send(Message{Type: tt.typ, Data: data}); !errors.Is(err, errQueueFull) {
+				t.Errorf("Send to a full queue = %v, want %v", err, errQueueFull)
+			}
+			if isClosing(c) != tt.disconnect {
+				t.Errorf("Disconnected = %v, want %v", isClosing(c), tt.disconnect)
+			}
+			if len(c.out) != cap(c.out) {
+				t.Errorf("%d messages queued, want the %d sent before", len(c.out), cap(c.out))
+			}
+		})
+	}
+}
+
+func TestMemoryBrokerWaitsForSlowSubscriberOnlyForOffersAndAnswers(t *testing.T) {
+	oldTimeout := brokerPublishTimeout
+	brokerPublishTimeout = 200 * time.Millisecond
+	t.Cleanup(func() { brokerPublishTimeout = oldTimeout })
+
+	b := NewMemoryBroker()
+	stuck := make(chan struct{}, 1)
+	release := make(chan struct{})
+	received := make(chan string, 2*brokerQueueSize)
+	unsubscribe, err := b.Subscribe("room", func(env Envelope) {
+		select {
+		case stuck <- struct{}{}:
+		default:
+		}
+		<-release
+		received <- env.Msg.Type
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unsubscribe()
+
+	// Fill the queue behind the envelope the handler is stuck on
+	if err := b.Publish("room", Envelope{Msg: Message{Type: "candidate"}}); err != nil {
+		t.Fatal(err)
+	}
+	<-stuck
+	filled := false
+	for range 2 * brokerQueueSize {
+		if err := b.Publish("room", Envelope{Msg: Message{Type: "candidate"}}); err != nil {
+			if !errors.Is(err, errBrokerBusy) {
+				t.Fatalf("Publish = %v, want %v", err, errBrokerBusy)
+			}
+			filled = true
+			break
+		}
+	}
+	if !filled {
+		t.Fatal("Queue never filled up")
+	}
+
+	// An offer waits, and fails only once the timeout is up
+	start := time.Now()
+	if err := b.Publish("room", Envelope{Msg: Message{Type: "offer"}}); !errors.Is(err, errBrokerBusy) {
+		t.Errorf("Publishing an offer to a stuck subscriber = %v, want %v", err, errBrokerBusy)
+	}
+	if waited := time.Since(start); waited < brokerPublishTimeout {
+		t.Errorf("Offer given up after %v, want it to wait %v", waited, brokerPublishTimeout)
+	}
+
+	// An answer gets through once the subscriber catches up
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		close(release)
+	}()
+	if err := b.Publish("room", Envelope{Msg: Message{Type: "answer"}}); err != nil {
+		t.Errorf("Publishing an answer to a subscriber catching up = %v", err)
+	}
+	deadline := time.After(time.Second)
+	for {
+		select {
+		case typ := <-received:
+			if typ == "answer" {
+				return
+			}
+		case <-deadline:
+			t.Fatal("Answer never delivered")
+		}
+	}
+}
+
+// busyBroker fails every publish, like a broker whose queue stays full
+type busyBroker struct {
+	Broker
+}
+
+func (busyBroker) Publish(string, Envelope) error {
+	return errBrokerBusy
+}
+
+func TestSenderDisconnectedWhenOfferCannotBePublished(t *testing.T) {
+	inst, url := startInstance(t, busyBroker{NewMemoryBroker()}, RoomLimits{EmptyGrace: time.Minute})
+	alice := joinPeer(t, url, "room")
+
+	// Bob is served by another instance, which alice's messages can't reach
+	room := inst.lookupRoom("room")
+	room.mu.Lock()
+	room.Remote["bob"] = PeerInfo{ID: "bob"}
+	room.mu.Unlock()
+
+	alice.send(Message{Type: "candidate", To: "bob", Data: json.RawMessage(`{"candidate":""}`)})
+	alice.send(Message{Type: "offer", To: "bob", Data: json.RawMessage(`{"type":"offer","sdp":"v=0"}`)})
+	alice.conn.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		_, _, err := alice.conn.ReadMessage()
+		if err == nil {
+			continue
+		}
+		var closeErr *websocket.CloseError
+		if !errors.As(err, &closeErr) || closeErr.Code != websocket.ClosePolicyViolation {
+			t.Fatalf("Waiting to be disconnected: %v", err)
+		}
+		return
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pion/turn/v4"
+)
+
+// ICEServer is a STUN/TURN server advertised to clients. The JSON layout
+// matches webrtc.ICEServer so clients can decode it directly.
+type ICEServer struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+}
+
+// SessionConfig is the payload of the "config" message sent to every client
+// right after the WebSocket upgrade
+type SessionConfig struct {
+	ICEServers         []ICEServer `json:"ice_servers"`
+	ICETransportPolicy string      `json:"ice_transport_policy,omitempty"`
+}
+
+// ICEConfig describes the external STUN/TURN servers advertised to clients
+type ICEConfig struct {
+	URLs            []string      // stun:, turn: and turns: URLs
+	Secret          string        // Shared secret the TURN servers use to verify credentials (coturn use-auth-secret)
+	CredentialTTL   time.Duration // Lifetime of generated credentials
+	TransportPolicy string        // "all" or "relay", empty to leave it to the client
+}
+
+// Validate checks that every TURN URL can be given credentials
+func (cfg ICEConfig) Validate() error {
+	for _, u := range cfg.URLs {
+		scheme, _, _ := strings.Cut(u, ":")
+		switch scheme {
+		case "stun", "stuns":
+		case "turn", "turns":
+			if cfg.Secret == "" {
+				return fmt.Errorf("TURN server %s requires -ice-secret", u)
+			}
+		default:
+			return fmt.Errorf("unsupported ICE server scheme %q in %s", scheme, u)
+		}
+	}
+	switch cfg.TransportPolicy {
+	case "", "all", "relay":
+	default:
+		return fmt.Errorf("invalid ICE transport policy %q (want all or relay)", cfg.TransportPolicy)
+	}
+	return nil
+}
+
+// sessionConfig builds the ICE configuration for a single client session.
+// TURN servers get ephemeral credentials bound to peerID, in the TURN REST
+// API format understood by coturn and pion/turn.
+func sessionConfig(peerID string) (SessionConfig, error) {
+	cfg := SessionConfig{
+		ICEServers:         []ICEServer{},
+		ICETransportPolicy: iceConfig.TransportPolicy,
+	}
+
+	var stunURLs, turnURLs []string
+	for _, u := range iceConfig.URLs {
+		if strings.HasPrefix(u, "turn:") || strings.HasPrefix(u, "turns:") {
+			turnURLs = append(turnURLs, u)
+		} else {
+			stunURLs = append(stunURLs, u)
+		}
+	}
+	if len(stunURLs) > 0 {
+		cfg.ICEServers = append(cfg.ICEServers, ICEServer{URLs: stunURLs})
+	}
+	if len(turnURLs) > 0 {
+		username, credential, err := turn.GenerateLongTermTURNRESTCredentials(iceConfig.Secret, peerID, iceConfig.CredentialTTL)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.ICEServers = append(cfg.ICEServers, ICEServer{URLs: turnURLs, Username: username, Credential: credential})
+	}
+
+	if turnConfig != nil {
+		embedded, err := turnConfig.ICEServersFor(peerID)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.ICEServers = append(cfg.ICEServers, embedded...)
+	}
+	return cfg, nil
+}
+
+// stringList collects the values of a repeatable flag
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
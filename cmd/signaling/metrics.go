@@ -0,0 +1,35 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Prometheus metrics, served on /metrics
+var (
+	roomsActive = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "clive_signaling_rooms",
+		Help: "Rooms currently open on this instance.",
+	})
+	connectionsActive = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "clive_signaling_connections",
+		Help: "WebSocket connections currently open on this instance.",
+	})
+	messagesRelayed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "clive_signaling_messages_relayed_total",
+		Help: "Messages relayed within rooms, by message type.",
+	}, []string{"type"})
+	writeErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "clive_signaling_write_errors_total",
+		Help: "Failed writes to client connections.",
+	})
+	upgradeFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "clive_signaling_upgrade_failures_total",
+		Help: "WebSocket handshakes that failed to upgrade.",
+	})
+	relayLatency = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "clive_signaling_relay_latency_seconds",
+		Help:    "Time from queuing a message for a client to writing it to the connection.",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 4, 10), // 100µs to ~26s
+	})
+)
@@ -0,0 +1,473 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var (
+	errRoomFull   = errors.New("room is full")
+	errRoomClosed = errors.New("room closed")
+)
+
+// PeerInfo is the metadata about a client shared with the rest of the room
+type PeerInfo struct {
+	ID       string    `json:"id"`
+	Name     string    `json:"name,omitempty"`
+	Role     string    `json:"role,omitempty"`
+	JoinedAt time.Time `json:"joined_at"`
+}
+
+// Roster is the payload of a "roster" message
+type Roster struct {
+	Peers []PeerInfo `json:"peers"`
+}
+
+// ErrorData is the payload of an "error" message
+type ErrorData struct {
+	Code    string `json:"code"` // e.g. "room-full", "room-expired"
+	Message string `json:"message"`
+}
+
+// RoomLimits controls how many clients a room accepts and how long it lives
+type RoomLimits struct {
+	MaxPeers   int           // Maximum clients per room, 0 for unlimited
+	EmptyGrace time.Duration // How long an empty room is kept before it is deleted
+	TTL        time.Duration // Maximum lifetime of a room, 0 for unlimited
+}
+
+// How often an instance tells the others it still serves its clients, and
+// how long the peers of an instance that went quiet are kept
+var (
+	heartbeatInterval = 10 * time.Second
+	instanceTimeout   = 30 * time.Second
+)
+
+// Instance is one signaling server: the rooms it serves and the broker it
+// shares them through with the other instances
+type Instance struct {
+	ID     string // Identifies this instance among those sharing the broker
+	broker Broker
+	limits RoomLimits
+
+	mu    sync.Mutex
+	rooms map[string]*Room
+
+	heartbeat time.Duration
+	timeout   time.Duration
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewInstance creates an instance applying limits to every room and
+// exchanging messages with the other instances through broker
+func NewInstance(broker Broker, limits RoomLimits) *Instance {
+	inst := &Instance{
+		ID:        newPeerID(),
+		broker:    broker,
+		limits:    limits,
+		rooms:     make(map[string]*Room),
+		heartbeat: heartbeatInterval,
+		timeout:   instanceTimeout,
+		done:      make(chan struct{}),
+	}
+	go inst.heartbeatLoop()
+	return inst
+}
+
+// Close stops the heartbeats. Rooms and clients are left alone.
+func (inst *Instance) Close() {
+	inst.closeOnce.Do(func() { close(inst.done) })
+}
+
+// Room manages the clients connected to this instance keyed by peer ID, and
+// tracks the peers other instances serve in the same room
+type Room struct {
+	Name      string
+	MaxPeers  int
+	CreatedAt time.Time
+	Clients   map[string]*Client
+	Remote    map[string]PeerInfo // Peers connected to other instances
+	mu        sync.Mutex
+
+	inst          *Instance
+	remoteBy      map[string]string    // Instance serving each remote peer
+	instancesSeen map[string]time.Time // When each other instance was last heard from
+
+	closed      bool        // Set once the room is removed from the rooms map
+	emptyTimer  *time.Timer // Deletes the room when it stays empty
+	ttlTimer    *time.Timer // Closes the room when its TTL runs out
+	unsubscribe func()      // Stops receiving the room's broker messages
+}
+
+// NewRoom creates a new Room instance
+func NewRoom(name string, maxPeers int) *Room {
+	return &Room{
+		Name:          name,
+		MaxPeers:      maxPeers,
+		CreatedAt:     time.Now(),
+		Clients:       make(map[string]*Client),
+		Remote:        make(map[string]PeerInfo),
+		remoteBy:      make(map[string]string),
+		instancesSeen: make(map[string]time.Time),
+	}
+}
+
+// getOrCreateRoom returns the room called name, creating it with maxPeers
+// capacity if it does not exist yet
+func (inst *Instance) getOrCreateRoom(name string, maxPeers int) *Room {
+	inst.mu.Lock()
+	if room, ok := inst.rooms[name]; ok {
+		inst.mu.Unlock()
+		return room
+	}
+
+	room := NewRoom(name, maxPeers)
+	room.inst = inst
+	inst.rooms[name] = room
+	roomsActive.Inc()
+	if ttl := inst.limits.TTL; ttl > 0 {
+		room.ttlTimer = time.AfterFunc(ttl, func() {
+			slog.Info("Room reached its TTL, closing it", "room", name, "ttl", ttl)
+			inst.closeRoom(room, "room-expired", "room lifetime exceeded")
+		})
+	}
+	inst.mu.Unlock()
+	slog.Info("Created room", "room", name, "max_peers", maxPeers)
+
+	// Subscribing may wait on the network, so it is done without holding
+	// inst.mu. Clients joining meanwhile learn about the remote peers from
+	// the peer-joined messages the sync brings back.
+	unsubscribe, err := inst.broker.Subscribe(name, room.handleEnvelope)
+	if err != nil {
+		slog.Warn("Room is limited to this instance", "room", name, "err", err)
+		return room
+	}
+	room.mu.Lock()
+	defer room.mu.Unlock()
+	if room.closed {
+		go unsubscribe()
+		return room
+	}
+	room.unsubscribe = unsubscribe
+	// Ask the other instances who is already in the room
+	room.publish(Envelope{Msg: Message{Type: "sync"}})
+	return room
+}
+
+// joinRoom adds self to the room called name and introduces it to the other
+// clients. maxPeers only applies if the room has to be created.
+func (inst *Instance) joinRoom(name string, maxPeers int, self *Client) (*Room, error) {
+	for {
+		room := inst.getOrCreateRoom(name, maxPeers)
+		err := room.join(self)
+		if errors.Is(err, errRoomClosed) {
+			continue // Lost a race with the room being deleted, use a fresh one
+		}
+		return room, err
+	}
+}
+
+// join adds self to the room, sends it its peer ID and the roster, and
+// announces it to everyone else, all under one lock so no client sees the
+// membership out of order
+func (room *Room) join(self *Client) error {
+	room.mu.Lock()
+	defer room.mu.Unlock()
+
+	if room.closed {
+		return errRoomClosed
+	}
+	if room.MaxPeers > 0 && len(room.Clients)+len(room.Remote) >= room.MaxPeers {
+		// The room may have just been created for self
+		room.deleteWhenEmpty()
+		return errRoomFull
+	}
+	if room.emptyTimer != nil {
+		room.emptyTimer.Stop()
+		room.emptyTimer = nil
+	}
+
+	roster := Roster{Peers: []PeerInfo{}}
+	for _, client := range room.Clients {
+		roster.Peers = append(roster.Peers, client.Info())
+	}
+	for _, info := range room.Remote {
+		roster.Peers = append(roster.Peers, info)
+	}
+	room.Clients[self.ID] = self
+
+	// Tell the client which peer ID it has been assigned and who is already
+	// here, then announce the newcomer to everyone else
+	if err := room.send(self, Message{Type: "welcome", To: self.ID}); err != nil {
+		slog.Warn("Failed to send", "room", room.Name, "peer_id", self.ID, "err", err)
+	}
+	rosterData, _ := json.Marshal(roster)
+	if err := room.send(self, Message{Type: "roster", To: self.ID, Data: rosterData}); err != nil {
+		slog.Warn("Failed to send", "room", room.Name, "peer_id", self.ID, "err", err)
+	}
+	selfInfo, _ := json.Marshal(self.Info())
+	room.relay(Message{Type: "peer-joined", From: self.ID, Data: selfInfo})
+
+	slog.Info("Client joined room", "room", room.Name, "peer_id", self.ID, "clients", len(room.Clients))
+	return nil
+}
+
+// leave removes self from the room, tells the remaining clients and
+// schedules the room for deletion once it is empty
+func (room *Room) leave(self *Client) {
+	room.mu.Lock()
+	defer room.mu.Unlock()
+
+	delete(room.Clients, self.ID)
+	slog.Info("Client left room", "room", room.Name, "peer_id", self.ID, "clients", len(room.Clients))
+	selfInfo, _ := json.Marshal(self.Info())
+	room.relay(Message{Type: "peer-left", From: self.ID, Data: selfInfo})
+	room.deleteWhenEmpty()
+}
+
+// deleteWhenEmpty schedules the room for deletion if it has no local clients
+// left. The caller must hold room.mu.
+func (room *Room) deleteWhenEmpty() {
+	if len(room.Clients) == 0 && !room.closed && room.emptyTimer == nil {
+		room.emptyTimer = time.AfterFunc(room.inst.limits.EmptyGrace, func() {
+			room.inst.deleteIfEmpty(room)
+		})
+	}
+}
+
+// lookupRoom returns the room called name, or nil if there is none
+func (inst *Instance) lookupRoom(name string) *Room {
+	inst.mu.Lock()
+	defer inst.mu.Unlock()
+	return inst.rooms[name]
+}
+
+// deleteIfEmpty removes room from the rooms map unless someone joined it
+// during the grace period
+func (inst *Instance) deleteIfEmpty(room *Room) {
+	inst.mu.Lock()
+	defer inst.mu.Unlock()
+	room.mu.Lock()
+	defer room.mu.Unlock()
+
+	if room.closed || len(room.Clients) > 0 {
+		return
+	}
+	inst.markClosed(room)
+	slog.Info("Deleted empty room", "room", room.Name)
+}
+
+// closeRoom removes room from the rooms map and disconnects all its clients
+// after sending them an error with the given code
+func (inst *Instance) closeRoom(room *Room, code, reason string) {
+	inst.mu.Lock()
+	defer inst.mu.Unlock()
+	room.mu.Lock()
+	defer room.mu.Unlock()
+
+	if room.closed {
+		return
+	}
+	inst.markClosed(room)
+
+	for _, client := range room.Clients {
+		client.SendError(code, reason)
+		client.Close(websocket.CloseNormalClosure, reason)
+	}
+	slog.Info("Closed room", "room", room.Name, "reason", reason)
+}
+
+// markClosed deletes the room from the rooms map and stops its timers and
+// its subscription. The caller must hold inst.mu and room.mu.
+func (inst *Instance) markClosed(room *Room) {
+	room.closed = true
+	if inst.rooms[room.Name] == room {
+		delete(inst.rooms, room.Name)
+		roomsActive.Dec()
+	}
+	if room.emptyTimer != nil {
+		room.emptyTimer.Stop()
+	}
+	if room.ttlTimer != nil {
+		room.ttlTimer.Stop()
+	}
+	if room.unsubscribe != nil {
+		// Unsubscribing may wait on the network; don't hold the locks for it
+		go room.unsubscribe()
+	}
+}
+
+// heartbeatLoop periodically tells the other instances which rooms this one
+// still serves clients in, and forgets the remote peers of instances that
+// stopped doing so
+func (inst *Instance) heartbeatLoop() {
+	ticker := time.NewTicker(inst.heartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-inst.done:
+			return
+		}
+
+		inst.mu.Lock()
+		rooms := make([]*Room, 0, len(inst.rooms))
+		for _, room := range inst.rooms {
+			rooms = append(rooms, room)
+		}
+		inst.mu.Unlock()
+
+		for _, room := range rooms {
+			room.mu.Lock()
+			if !room.closed {
+				if len(room.Clients) > 0 {
+					room.publish(Envelope{Msg: Message{Type: "heartbeat"}})
+				}
+				room.expireRemote()
+			}
+			room.mu.Unlock()
+		}
+	}
+}
+
+// expireRemote drops the remote peers whose instance hasn't been heard from
+// for inst.timeout, e.g. because it crashed without announcing they left.
+// The caller must hold room.mu.
+func (room *Room) expireRemote() {
+	for instance, seen := range room.instancesSeen {
+		if time.Since(seen) < room.inst.timeout {
+			continue
+		}
+		delete(room.instancesSeen, instance)
+		for id, by := range room.remoteBy {
+			if by != instance {
+				continue
+			}
+			info, _ := json.Marshal(room.Remote[id])
+			delete(room.Remote, id)
+			delete(room.remoteBy, id)
+			slog.Info("Dropping peer of an unresponsive instance", "room", room.Name, "peer_id", id, "instance", instance)
+			room.broadcast(Message{Type: "peer-left", From: id, Data: info})
+		}
+	}
+}
+
+// send queues msg for a single client. The caller must hold room.mu.
+func (room *Room) send(client *Client, msg Message) error {
+	return client.Send(msg)
+}
+
+// relay delivers msg to the peer named in msg.To, or to every client except
+// the sender when msg.To is empty, forwarding it to the other instances
+// unless the recipient is connected here. Delivery never blocks on a client;
+// what happens when one cannot keep up is up to Client.Send. The caller must
+// hold room.mu.
+func (room *Room) relay(msg Message) {
+	messagesRelayed.WithLabelValues(msg.Type).Inc()
+	if msg.To != "" {
+		if client, ok := room.Clients[msg.To]; ok {
+			room.deliver(client, msg)
+			return
+		}
+		if _, ok := room.Remote[msg.To]; !ok {
+			slog.Debug("Dropping message for unknown peer", "room", room.Name, "type", msg.Type, "peer_id", msg.From, "to", msg.To)
+			return
+		}
+	} else {
+		room.broadcast(msg)
+	}
+	if err := room.publish(Envelope{Msg: msg}); err != nil && undroppableMessages[msg.Type] {
+		// Like a slow client, the sender is disconnected rather than left
+		// waiting for an answer that won't come; it rejoins and renegotiates
+		if sender, ok := room.Clients[msg.From]; ok {
+			slog.Warn("Could not relay to other instances, disconnecting sender", "room", room.Name, "type", msg.Type, "peer_id", msg.From)
+			sender.Close(websocket.ClosePolicyViolation, "signaling backlog")
+		}
+	}
+}
+
+// broadcast delivers msg to every local client except the sender. The
+// caller must hold room.mu.
+func (room *Room) broadcast(msg Message) {
+	for id, client := range room.Clients {
+		if id != msg.From {
+			room.deliver(client, msg)
+		}
+	}
+}
+
+func (room *Room) deliver(client *Client, msg Message) {
+	if err := room.send(client, msg); err != nil {
+		slog.Warn("Failed to relay", "room", room.Name, "type", msg.Type, "peer_id", client.ID, "err", err)
+	}
+}
+
+// publish hands env to the broker for the other instances
+func (room *Room) publish(env Envelope) error {
+	env.Instance = room.inst.ID
+	err := room.inst.broker.Publish(room.Name, env)
+	if err != nil {
+		slog.Warn("Failed to publish", "room", room.Name, "type", env.Msg.Type, "err", err)
+	}
+	return err
+}
+
+// handleEnvelope delivers a message relayed by another instance to the local
+// clients and keeps track of which peers the other instances serve
+func (room *Room) handleEnvelope(env Envelope) {
+	if env.Instance == room.inst.ID || (env.ToInstance != "" && env.ToInstance != room.inst.ID) {
+		return
+	}
+
+	room.mu.Lock()
+	defer room.mu.Unlock()
+	if room.closed {
+		return
+	}
+	room.instancesSeen[env.Instance] = time.Now()
+
+	msg := env.Msg
+	switch msg.Type {
+	case "heartbeat":
+		return
+	case "sync":
+		// Another instance just started serving this room; introduce our
+		// clients to it
+		for _, client := range room.Clients {
+			info, _ := json.Marshal(client.Info())
+			room.publish(Envelope{
+				ToInstance: env.Instance,
+				Msg:        Message{Type: "peer-joined", From: client.ID, Data: info},
+			})
+		}
+		return
+	case "peer-joined":
+		var info PeerInfo
+		if err := json.Unmarshal(msg.Data, &info); err != nil {
+			slog.Warn("Invalid peer-joined", "room", room.Name, "instance", env.Instance, "err", err)
+			return
+		}
+		if _, ok := room.Remote[msg.From]; ok {
+			return // Already announced
+		}
+		room.Remote[msg.From] = info
+		room.remoteBy[msg.From] = env.Instance
+	case "peer-left":
+		delete(room.Remote, msg.From)
+		delete(room.remoteBy, msg.From)
+	}
+
+	if msg.To != "" {
+		if client, ok := room.Clients[msg.To]; ok {
+			room.deliver(client, msg)
+		}
+		return
+	}
+	room.broadcast(msg)
+}
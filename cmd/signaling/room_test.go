@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// startInstance serves a new instance using broker over HTTP and returns it
+// with its WebSocket URL
+func startInstance(t *testing.T, broker Broker, limits RoomLimits) (*Instance, string) {
+	t.Helper()
+	inst := NewInstance(broker, limits)
+	srv := httptest.NewServer(http.HandlerFunc(inst.handleWebSocket))
+	t.Cleanup(func() {
+		srv.Close()
+		inst.Close()
+	})
+	return inst, "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+// testPeer is a signaling client connected to an instance
+type testPeer struct {
+	t    *testing.T
+	ID   string
+	conn *websocket.Conn
+}
+
+// joinPeer connects to the instance at url and waits for its peer ID
+func joinPeer(t *testing.T, url, room string) *testPeer {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial(url+"?room="+room, nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	p := &testPeer{t: t, conn: conn}
+	p.ID = p.expect("welcome", "").To
+	return p
+}
+
+// expect reads messages until one of type typ from peer from arrives,
+// failing the test if none does within a second
+func (p *testPeer) expect(typ, from string) Message {
+	p.t.Helper()
+	p.conn.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		var msg Message
+		if err := p.conn.ReadJSON(&msg); err != nil {
+			p.t.Fatalf("Waiting for %s from %q: %v", typ, from, err)
+		}
+		if msg.Type == typ && msg.From == from {
+			return msg
+		}
+	}
+}
+
+// expectPeer waits until p knows about peer id, from the roster or a
+// peer-joined message
+func (p *testPeer) expectPeer(id string) {
+	p.t.Helper()
+	p.conn.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		var msg Message
+		if err := p.conn.ReadJSON(&msg); err != nil {
+			p.t.Fatalf("Waiting for peer %s: %v", id, err)
+		}
+		switch msg.Type {
+		case "peer-joined":
+			if msg.From == id {
+				return
+			}
+		case "roster":
+			var roster Roster
+			json.Unmarshal(msg.Data, &roster)
+			for _, info := range roster.Peers {
+				if info.ID == id {
+					return
+				}
+			}
+		}
+	}
+}
+
+func (p *testPeer) send(msg Message) {
+	p.t.Helper()
+	if err := p.conn.WriteJSON(msg); err != nil {
+		p.t.Fatalf("Send: %v", err)
+	}
+}
+
+// cutBroker stops publishing once cut, like an instance that died
+type cutBroker struct {
+	Broker
+	cut atomic.Bool
+}
+
+func (b *cutBroker) Publish(room string, env Envelope) error {
+	if b.cut.Load() {
+		return nil
+	}
+	return b.Broker.Publish(room, env)
+}
+
+func TestTwoInstancesShareRoom(t *testing.T) {
+	broker := NewMemoryBroker()
+	_, url1 := startInstance(t, broker, RoomLimits{EmptyGrace: time.Minute})
+	_, url2 := startInstance(t, broker, RoomLimits{EmptyGrace: time.Minute})
+
+	alice := joinPeer(t, url1, "shared")
+	bob := joinPeer(t, url2, "shared")
+	alice.expect("peer-joined", bob.ID)
+	bob.expectPeer(alice.ID)
+
+	offer := json.RawMessage(`{"type":"offer","sdp":"v=0"}`)
+	bob.send(Message{Type: "offer", To: alice.ID, Data: offer})
+	if got := alice.expect("offer", bob.ID); string(got.Data) != string(offer) {
+		t.Errorf("Offer data = %s, want %s", got.Data, offer)
+	}
+	alice.send(Message{Type: "answer", To: bob.ID, Data: json.RawMessage(`{"type":"answer","sdp":"v=0"}`)})
+	bob.expect("answer", alice.ID)
+
+	bob.conn.Close()
+	alice.expect("peer-left", bob.ID)
+}
+
+func TestRoomsAreSeparate(t *testing.T) {
+	broker := NewMemoryBroker()
+	_, url1 := startInstance(t, broker, RoomLimits{EmptyGrace: time.Minute})
+	_, url2 := startInstance(t, broker, RoomLimits{EmptyGrace: time.Minute})
+
+	alice := joinPeer(t, url1, "one")
+	bob := joinPeer(t, url2, "two")
+	carol := joinPeer(t, url2, "one")
+	alice.expect("peer-joined", carol.ID)
+
+	// Bob's offer, if it got through, would arrive before carol's
+	offer := json.RawMessage(`{"type":"offer","sdp":"v=0"}`)
+	bob.send(Message{Type: "offer", To: alice.ID, Data: offer})
+	time.Sleep(50 * time.Millisecond)
+	carol.send(Message{Type: "offer", To: alice.ID, Data: offer})
+	alice.conn.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		var msg Message
+		if err := alice.conn.ReadJSON(&msg); err != nil {
+			t.Fatalf("Waiting for carol's offer: %v", err)
+		}
+		if msg.Type != "offer" {
+			continue
+		}
+		if msg.From != carol.ID {
+			t.Fatalf("Got an offer from %s in another room", msg.From)
+		}
+		break
+	}
+}
+
+func TestRemotePeersOfSilentInstanceExpire(t *testing.T) {
+	oldHeartbeat, oldTimeout := heartbeatInterval, instanceTimeout
+	heartbeatInterval, instanceTimeout = 20*time.Millisecond, 100*time.Millisecond
+	t.Cleanup(func() { heartbeatInterval, instanceTimeout = oldHeartbeat, oldTimeout })
+
+	shared := NewMemoryBroker()
+	dying := &cutBroker{Broker: shared}
+	inst1, url1 := startInstance(t, shared, RoomLimits{EmptyGrace: time.Minute})
+	_, url2 := startInstance(t, dying, RoomLimits{EmptyGrace: time.Minute})
+
+	alice := joinPeer(t, url1, "room")
+	bob := joinPeer(t, url2, "room")
+	alice.expect("peer-joined", bob.ID)
+
+	// Heartbeats keep bob around well past the timeout
+	time.Sleep(3 * instanceTimeout)
+	room := inst1.lookupRoom("room")
+	room.mu.Lock()
+	_, ok := room.Remote[bob.ID]
+	room.mu.Unlock()
+	if !ok {
+		t.Fatal("Remote peer expired although its instance is alive")
+	}
+
+	dying.cut.Store(true)
+	alice.expect("peer-left", bob.ID)
+	room.mu.Lock()
+	defer room.mu.Unlock()
+	if len(room.Remote) != 0 {
+		t.Errorf("Remote peers = %v, want none", room.Remote)
+	}
+}
+
+func TestRejectedJoinDoesNotLeakRoom(t *testing.T) {
+	inst := NewInstance(NewMemoryBroker(), RoomLimits{EmptyGrace: 10 * time.Millisecond})
+	t.Cleanup(inst.Close)
+
+	// Full of peers served by another instance
+	room := inst.getOrCreateRoom("full", 1)
+	room.mu.Lock()
+	room.Remote["remote"] = PeerInfo{ID: "remote"}
+	room.mu.Unlock()
+	if err := room.join(&Client{ID: "local"}); !errors.Is(err, errRoomFull) {
+		t.Fatalf("join = %v, want %v", err, errRoomFull)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for inst.lookupRoom("full") != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("Room the rejected client created was never deleted")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestMaxPeers(t *testing.T) {
+	_, url := startInstance(t, NewMemoryBroker(), RoomLimits{MaxPeers: 3, EmptyGrace: time.Minute})
+
+	// The first client asks for a lower limit; later ones can't change it
+	joinPeer(t, url, "small&max_peers=2")
+	joinPeer(t, url, "small&max_peers=5")
+	conn, _, err := websocket.DefaultDialer.Dial(url+"?room=small", nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	rejected := &testPeer{t: t, conn: conn}
+	rejected.expectClosed("room-full")
+
+	// Nor can a client raise the server's limit
+	for range 3 {
+		joinPeer(t, url, "big&max_peers=10")
+	}
+	conn, _, err = websocket.DefaultDialer.Dial(url+"?room=big&max_peers=10", nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	rejected = &testPeer{t: t, conn: conn}
+	rejected.expectClosed("room-full")
+}
+
+func TestEmptyRoomGrace(t *testing.T) {
+	const grace = 100 * time.Millisecond
+	inst, url := startInstance(t, NewMemoryBroker(), RoomLimits{EmptyGrace: grace})
+
+	alice := joinPeer(t, url, "room")
+	room := inst.lookupRoom("room")
+	alice.conn.Close()
+
+	// Rejoining within the grace period keeps the room
+	time.Sleep(grace / 2)
+	bob := joinPeer(t, url, "room")
+	time.Sleep(grace)
+	if inst.lookupRoom("room") != room {
+		t.Fatal("Room deleted although a client rejoined during the grace period")
+	}
+
+	bob.conn.Close()
+	time.Sleep(grace / 2)
+	if inst.lookupRoom("room") != room {
+		t.Fatal("Room deleted before the grace period was up")
+	}
+	deadline := time.Now().Add(time.Second)
+	for inst.lookupRoom("room") != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("Empty room never deleted")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestRoomTTL(t *testing.T) {
+	const ttl = 100 * time.Millisecond
+	inst, url := startInstance(t, NewMemoryBroker(), RoomLimits{EmptyGrace: time.Minute, TTL: ttl})
+
+	start := time.Now()
+	alice := joinPeer(t, url, "room")
+	bob := joinPeer(t, url, "room")
+	alice.expectClosed("room-expired")
+	if age := time.Since(start); age < ttl {
+		t.Errorf("Room closed after %v, want %v", age, ttl)
+	}
+	bob.expectClosed("room-expired")
+	if inst.lookupRoom("room") != nil {
+		t.Error("Expired room still listed")
+	}
+
+	// Joining again starts a new room with a lifetime of its own
+	joinPeer(t, url, "room")
+	if room := inst.lookupRoom("room"); room == nil || time.Since(room.CreatedAt) > ttl {
+		t.Error("No fresh room after the old one expired")
+	}
+}
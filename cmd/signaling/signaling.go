@@ -1,14 +1,24 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
-	"sync"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"clive/internal/logging"
 
 	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 var upgrader = websocket.Upgrader{
@@ -17,119 +27,346 @@ var upgrader = websocket.Upgrader{
 	},
 }
 
-// Room manages a set of connected clients
-type Room struct {
-	Clients map[*websocket.Conn]bool
-	mu      sync.Mutex
+// Token validation for /ws, nil when authentication is disabled
+var auth *Authenticator
+
+// Keepalive settings: how often clients are pinged and how long they may stay
+// silent before they are considered dead
+var (
+	pingInterval = 20 * time.Second
+	pongTimeout  = 60 * time.Second
+)
+
+// External ICE servers advertised to clients
+var iceConfig ICEConfig
+
+// Embedded STUN/TURN server advertised to clients, nil when disabled
+var turnConfig *TURNConfig
+
+// Message represents the signaling JSON structure
+type Message struct {
+	Type string          `json:"type"`           // e.g., "offer", "answer", "candidate", "roster", "peer-joined", "peer-left", "error"
+	From string          `json:"from,omitempty"` // Peer ID of the sender, stamped by the server
+	To   string          `json:"to,omitempty"`   // Peer ID of the recipient, empty to broadcast
+	Data json.RawMessage `json:"data,omitempty"` // Contains the SDP, ICE candidate or peer metadata
 }
 
-// NewRoom creates a new Room instance
-func NewRoom() *Room {
-	return &Room{
-		Clients: make(map[*websocket.Conn]bool),
+// newPeerID returns a random identifier for a newly connected client
+func newPeerID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
 	}
+	return hex.EncodeToString(b)
 }
 
-// Global rooms map: roomName -> *Room
-var rooms = make(map[string]*Room)
-var roomsMu sync.Mutex
+// startKeepalive pings conn every interval and expects some traffic at least
+// every timeout, so reads on a half-open connection fail instead of blocking
+// forever. The returned function stops the pings.
+func startKeepalive(conn *websocket.Conn, interval, timeout time.Duration) (stop func()) {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(timeout))
+	})
 
-// Message represents the signaling JSON structure
-type Message struct {
-	Type string          `json:"type"` // e.g., "offer", "answer", "candidate", "join"
-	Data json.RawMessage `json:"data"` // Contains the SDP or ICE candidate
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(interval)); err != nil {
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
 }
 
-func handleWebSocket(w http.ResponseWriter, r *http.Request) {
+func (inst *Instance) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	roomName := r.URL.Query().Get("room")
 	if roomName == "" {
 		roomName = "default" // Default room if none provided
 	}
 
+	// Reject unauthenticated clients before upgrading the connection
+	role := RolePeer
+	if auth != nil {
+		claims, err := auth.Authorize(r, roomName)
+		if err != nil {
+			slog.Warn("Rejected connection", "room", roomName, "remote_addr", r.RemoteAddr, "err", err)
+			authError(w, err)
+			return
+		}
+		role = claims.Role
+	}
+
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Println("Upgrade error:", err)
+		upgradeFailures.Inc()
+		slog.Warn("Upgrade failed", "room", roomName, "remote_addr", r.RemoteAddr, "err", err)
 		return
 	}
+	connectionsActive.Inc()
+	defer connectionsActive.Dec()
+	self := NewClient(newPeerID(), conn)
+	self.Name = r.URL.Query().Get("name")
+	self.Role = role
+	self.JoinedAt = time.Now()
+	self.RemoteAddr = r.RemoteAddr
+	conn.SetReadLimit(maxMessageSize)
+	timeout := pongTimeout
+	stopKeepalive := startKeepalive(conn, pingInterval, timeout)
+	defer stopKeepalive()
 
-	// Add client to room
-	roomsMu.Lock()
-	room, exists := rooms[roomName]
-	if !exists {
-		room = NewRoom()
-		rooms[roomName] = room
+	// Hand the client its ICE configuration before anything else so it is in
+	// place by the time the first PeerConnection is created
+	session, err := sessionConfig(self.ID)
+	if err != nil {
+		slog.Error("Failed to generate ICE config", "peer_id", self.ID, "err", err)
 	}
-	roomsMu.Unlock()
-
-	room.mu.Lock()
-	room.Clients[conn] = true
-	clientCount := len(room.Clients)
-	room.mu.Unlock()
+	sessionData, _ := json.Marshal(session)
+	self.Send(Message{Type: "config", To: self.ID, Data: sessionData})
 
-	log.Printf("Client connected to room: %s. Total clients: %d\n", roomName, clientCount)
-
-	if clientCount > 1 {
-		// Notify EVERYONE in the room that we are ready to communicate
-		msg := Message{Type: "peer-ready"}
-		msgBytes, _ := json.Marshal(msg)
-
-		room.mu.Lock()
-		for client := range room.Clients {
-			client.WriteMessage(websocket.TextMessage, msgBytes)
-		}
-		room.mu.Unlock()
+	// Add client to room, honoring a requested capacity when the room is new
+	maxPeers := inst.limits.MaxPeers
+	if v, err := strconv.Atoi(r.URL.Query().Get("max_peers")); err == nil && v > 0 && (maxPeers == 0 || v < maxPeers) {
+		maxPeers = v
+	}
+	room, err := inst.joinRoom(roomName, maxPeers, self)
+	if err != nil {
+		slog.Info("Rejected client", "room", roomName, "peer_id", self.ID, "err", err)
+		self.SendError("room-full", err.Error())
+		self.Close(websocket.ClosePolicyViolation, err.Error())
+		return
 	}
 
 	defer func() {
-		room.mu.Lock()
-		delete(room.Clients, conn)
-		log.Printf("Client disconnected from room: %s. Total clients: %d\n", roomName, len(room.Clients))
-		room.mu.Unlock()
-		conn.Close()
+		room.leave(self)
+		self.Close(websocket.CloseNormalClosure, "")
 	}()
 
+	limiter := newMessageLimiter()
 	for {
 		messageType, p, err := conn.ReadMessage()
 		if err != nil {
-			log.Println("Read error:", err)
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				slog.Info("Peer timed out without a pong, evicting it", "room", roomName, "peer_id", self.ID, "timeout", timeout)
+			} else if errors.Is(err, websocket.ErrReadLimit) {
+				slog.Warn("Peer sent an oversized message, disconnecting it", "room", roomName, "peer_id", self.ID, "limit", maxMessageSize)
+			} else {
+				slog.Info("Read error", "room", roomName, "peer_id", self.ID, "err", err)
+			}
 			break
 		}
+		conn.SetReadDeadline(time.Now().Add(timeout))
 
+		if allow, notify, disconnect := limiter.check(time.Now()); !allow {
+			if disconnect {
+				slog.Warn("Peer kept exceeding the message rate, disconnecting it", "room", roomName, "peer_id", self.ID, "rate", messageRate)
+				self.Close(websocket.ClosePolicyViolation, "message rate exceeded")
+				break
+			}
+			if notify {
+				slog.Warn("Peer exceeded message rate, dropping messages", "room", roomName, "peer_id", self.ID, "rate", messageRate)
+				self.SendError(ErrCodeRateLimited, "too many messages, slow down")
+			}
+			continue
+		}
 		if messageType != websocket.TextMessage {
+			self.SendError(ErrCodeInvalidMessage, "only text frames with JSON messages are accepted")
 			continue
 		}
 
-		// Broadcast message to all OTHER clients in the room
-		room.mu.Lock()
-		for client := range room.Clients {
-			if client != conn {
-				err := client.WriteMessage(websocket.TextMessage, p)
-				if err != nil {
-					log.Printf("Write error to a client: %v\n", err)
-					client.Close()
-					delete(room.Clients, client)
-				}
+		var msg Message
+		if err := json.Unmarshal(p, &msg); err != nil {
+			slog.Warn("Invalid message", "room", roomName, "peer_id", self.ID, "err", err)
+			self.SendError(ErrCodeInvalidMessage, "message is not valid JSON: "+err.Error())
+			continue
+		}
+		if err := validateMessage(msg); err != nil {
+			slog.Warn("Rejected message", "room", roomName, "peer_id", self.ID, "type", msg.Type, "err", err)
+			code := ErrCodeInvalidMessage
+			if errors.Is(err, errUnknownType) {
+				code = ErrCodeUnknownType
 			}
+			self.SendError(code, err.Error())
+			continue
 		}
+		// Never trust the sender to identify itself
+		msg.From = self.ID
+
+		// Deliver to the addressed peer, or broadcast to all OTHER clients
+		room.mu.Lock()
+		room.relay(msg)
 		room.mu.Unlock()
 	}
 }
 
 func main() {
 	addr := flag.String("addr", ":8080", "Host:port to run signaling server on (e.g., :8080 or localhost:8080)")
+	adminAddr := flag.String("admin-addr", "localhost:8079", "Host:port for the admin API, kept off -addr so it isn't public by default; disabled if empty")
+	turnAddr := flag.String("turn-addr", "", "Host:port for the embedded STUN/TURN server (UDP and TCP, e.g. :3478); disabled if empty")
+	turnPublicIP := flag.String("turn-public-ip", "", "Public IP address of this host, used for relayed candidates")
+	turnHost := flag.String("turn-host", "", "Host name advertised to clients for the TURN server (defaults to -turn-public-ip)")
+	turnRealm := flag.String("turn-realm", "clive", "TURN realm")
+	turnUsers := flag.String("turn-users", "", "Static TURN credentials as user=password pairs, comma separated")
+	turnSecret := flag.String("turn-secret", "", "Shared secret for time-limited TURN REST API credentials")
+	turnTTL := flag.Duration("turn-credential-ttl", 12*time.Hour, "Lifetime of time-limited TURN credentials handed to clients")
+	var iceURLs stringList
+	flag.Var(&iceURLs, "ice-server", "External STUN/TURN server URL advertised to clients (repeatable)")
+	iceSecret := flag.String("ice-secret", "", "Shared secret of the external TURN servers, used to generate per-session credentials")
+	iceTTL := flag.Duration("ice-credential-ttl", 12*time.Hour, "Lifetime of credentials generated for external TURN servers")
+	icePolicy := flag.String("ice-transport-policy", "", "ICE transport policy advertised to clients: all or relay")
+	authSecret := flag.String("auth-secret", os.Getenv("CLIVE_AUTH_SECRET"), "Shared secret for signing and validating room tokens (default $CLIVE_AUTH_SECRET); authentication is disabled if empty")
+	issue := flag.Bool("issue-token", false, "Print a token signed with the auth secret and exit")
+	tokenRoom := flag.String("token-room", "*", "Room claim for -issue-token (* for any room)")
+	tokenRole := flag.String("token-role", RolePeer, "Role claim for -issue-token: peer or admin")
+	tokenTTL := flag.Duration("token-ttl", 24*time.Hour, "Lifetime of the token printed by -issue-token (0 for no expiry)")
+	maxPeers := flag.Int("max-peers", 0, "Maximum clients per room, 0 for unlimited; clients may request a lower limit with ?max_peers= when creating a room")
+	roomGrace := flag.Duration("room-grace", 30*time.Second, "How long an empty room is kept before it is deleted")
+	roomTTL := flag.Duration("room-ttl", 0, "Maximum lifetime of a room before all its clients are disconnected, 0 for unlimited")
+	flag.DurationVar(&pingInterval, "ping-interval", pingInterval, "How often to ping clients")
+	flag.DurationVar(&pongTimeout, "pong-timeout", pongTimeout, "Evict clients that send nothing (not even a pong) for this long")
+	flag.IntVar(&sendQueueSize, "send-queue", sendQueueSize, "Outbound messages buffered per client")
+	flag.StringVar(&slowClientPolicy, "slow-client", slowClientPolicy, "What to do when a client's send queue is full: disconnect (the client) or drop (the message; offers and answers still disconnect)")
+	flag.Int64Var(&maxMessageSize, "max-message-size", maxMessageSize, "Largest message a client may send, in bytes; bigger messages disconnect the client")
+	flag.Float64Var(&messageRate, "message-rate", messageRate, "Messages per second each client may send on average")
+	flag.IntVar(&messageBurst, "message-burst", messageBurst, "Messages each client may send in a burst above -message-rate")
+	brokerSpec := flag.String("broker", "memory", "Pub/sub backend shared by signaling instances: memory (single instance) or a redis:// URL")
+	tlsCert := flag.String("tls-cert", "", "TLS certificate file; serves wss:// when set together with -tls-key")
+	tlsKey := flag.String("tls-key", "", "TLS private key file")
+	logFormat := flag.String("log-format", "text", "Log format: text or json")
+	logLevel := flag.String("log-level", "info", "Minimum log level: debug, info, warn or error")
 	flag.Parse()
 
-	http.HandleFunc("/ws", handleWebSocket)
+	if err := logging.Setup(*logFormat, *logLevel); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	if pingInterval <= 0 || pongTimeout <= pingInterval {
+		logging.Fatal("-ping-interval must be positive and shorter than -pong-timeout")
+	}
+	if slowClientPolicy != SlowClientDrop && slowClientPolicy != SlowClientDisconnect {
+		logging.Fatal("Invalid -slow-client (want drop or disconnect)", "slow_client", slowClientPolicy)
+	}
+	if sendQueueSize <= 0 {
+		logging.Fatal("-send-queue must be positive")
+	}
+	if maxMessageSize <= 0 || messageRate <= 0 || messageBurst <= 0 {
+		logging.Fatal("-max-message-size, -message-rate and -message-burst must be positive")
+	}
+
+	limits := RoomLimits{
+		MaxPeers:   *maxPeers,
+		EmptyGrace: *roomGrace,
+		TTL:        *roomTTL,
+	}
+
+	if (*tlsCert == "") != (*tlsKey == "") {
+		logging.Fatal("-tls-cert and -tls-key must be set together")
+	}
+
+	auth = NewAuthenticator(*authSecret)
+	if *issue {
+		if err := issueToken(auth, *tokenRoom, *tokenRole, *tokenTTL); err != nil {
+			logging.Fatal("Failed to issue token", "err", err)
+		}
+		return
+	}
+	if auth == nil {
+		slog.Warn("No auth secret configured, anyone can join any room")
+	}
+
+	iceConfig = ICEConfig{
+		URLs:            iceURLs,
+		Secret:          *iceSecret,
+		CredentialTTL:   *iceTTL,
+		TransportPolicy: *icePolicy,
+	}
+	if err := iceConfig.Validate(); err != nil {
+		logging.Fatal("Invalid ICE configuration", "err", err)
+	}
+
+	if *turnAddr != "" {
+		users, err := parseTURNUsers(*turnUsers)
+		if err != nil {
+			logging.Fatal("Invalid -turn-users", "err", err)
+		}
+		turnConfig = &TURNConfig{
+			Addr:          *turnAddr,
+			PublicIP:      *turnPublicIP,
+			Host:          *turnHost,
+			Realm:         *turnRealm,
+			Users:         users,
+			Secret:        *turnSecret,
+			CredentialTTL: *turnTTL,
+		}
+		turnServer, err := startTURNServer(*turnConfig)
+		if err != nil {
+			logging.Fatal("Failed to start TURN server", "err", err)
+		}
+		defer turnServer.Close()
+		slog.Info("STUN/TURN server listening", "addr", *turnAddr, "relay_ip", *turnPublicIP)
+	}
+
+	b, err := newBroker(*brokerSpec)
+	if err != nil {
+		logging.Fatal("Failed to set up broker", "err", err)
+	}
+	inst := NewInstance(b, limits)
+	brokerName := *brokerSpec
+	if u, err := url.Parse(brokerName); err == nil {
+		brokerName = u.Redacted() // Hide Redis passwords
+	}
+	slog.Info("Using broker", "instance", inst.ID, "broker", brokerName)
+
+	http.HandleFunc("/ws", inst.handleWebSocket)
+	http.Handle("/metrics", promhttp.Handler())
+
+	if *adminAddr != "" {
+		if auth == nil && !isLoopbackAddr(*adminAddr) {
+			slog.Warn("Admin API is reachable from other hosts without authentication", "addr", *adminAddr)
+		}
+		adminMux := http.NewServeMux()
+		registerAdminHandlers(adminMux, inst)
+		go func() {
+			// Served over TLS like /ws when it is configured, so admin tokens
+			// and calls aren't sent in the clear
+			slog.Info("Admin API listening", "addr", *adminAddr, "tls", *tlsCert != "")
+			var err error
+			if *tlsCert != "" {
+				err = http.ListenAndServeTLS(*adminAddr, *tlsCert, *tlsKey, adminMux)
+			} else {
+				err = http.ListenAndServe(*adminAddr, adminMux)
+			}
+			if err != nil {
+				logging.Fatal("Admin API failed", "err", err)
+			}
+		}()
+	}
 
 	displayAddr := *addr
 	if displayAddr[0] == ':' {
 		displayAddr = "localhost" + displayAddr
 	}
-	fmt.Printf("Signaling Server starting on ws://%s/ws\n", displayAddr)
-	fmt.Println("Connect with query parameter: /ws?room=myroom")
+	scheme := "ws"
+	if *tlsCert != "" {
+		scheme = "wss"
+	}
+	slog.Info("Signaling server starting", "url", scheme+"://"+displayAddr+"/ws?room=myroom")
 
-	err := http.ListenAndServe(*addr, nil)
+	if *tlsCert != "" {
+		err = http.ListenAndServeTLS(*addr, *tlsCert, *tlsKey, nil)
+	} else {
+		err = http.ListenAndServe(*addr, nil)
+	}
 	if err != nil {
-		log.Fatal("ListenAndServe:", err)
+		logging.Fatal("Server failed", "err", err)
 	}
 }
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// shortKeepalive makes the server ping every 20ms and evict clients silent
+// for 100ms for the rest of the test
+func shortKeepalive(t *testing.T) {
+	oldInterval, oldTimeout := pingInterval, pongTimeout
+	pingInterval, pongTimeout = 20*time.Millisecond, 100*time.Millisecond
+	t.Cleanup(func() { pingInterval, pongTimeout = oldInterval, oldTimeout })
+}
+
+func TestSilentPeerEvicted(t *testing.T) {
+	shortKeepalive(t)
+	_, url := startInstance(t, NewMemoryBroker(), RoomLimits{EmptyGrace: time.Minute})
+
+	alice := joinPeer(t, url, "room")
+	// Bob never reads again, so he doesn't answer pings
+	bob := joinPeer(t, url, "room")
+
+	start := time.Now()
+	alice.expect("peer-left", bob.ID)
+	if waited := time.Since(start); waited < pongTimeout/2 {
+		t.Errorf("Evicted after %v, before the %v timeout", waited, pongTimeout)
+	}
+}
+
+func TestPeerAnsweringPingsStays(t *testing.T) {
+	shortKeepalive(t)
+	_, url := startInstance(t, NewMemoryBroker(), RoomLimits{EmptyGrace: time.Minute})
+
+	alice := joinPeer(t, url, "room")
+	bob := joinPeer(t, url, "room")
+	alice.expect("peer-joined", bob.ID)
+
+	// Reading answers the server's pings, though bob sends nothing himself
+	left := make(chan struct{})
+	go func() {
+		defer close(left)
+		for {
+			if _, _, err := bob.conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	alice.conn.SetReadDeadline(time.Now().Add(5 * pongTimeout))
+	for {
+		var msg Message
+		if err := alice.conn.ReadJSON(&msg); err != nil {
+			break // Deadline reached with bob still there
+		}
+		if msg.Type == "peer-left" {
+			t.Fatalf("%s evicted although it answers pings", msg.From)
+		}
+	}
+	select {
+	case <-left:
+		t.Fatal("Bob's connection closed although he answers pings")
+	default:
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/pion/turn/v4"
+)
+
+// TURNConfig configures the optional embedded STUN/TURN server
+type TURNConfig struct {
+	Addr          string            // UDP and TCP listen address, e.g. ":3478"; empty disables the server
+	PublicIP      string            // IP address relayed candidates are allocated on
+	Host          string            // Host name advertised to clients, defaults to PublicIP
+	Realm         string            // TURN realm
+	Users         map[string]string // Static username -> password credentials
+	Secret        string            // Shared secret for time-limited REST API credentials
+	CredentialTTL time.Duration     // Lifetime of generated time-limited credentials
+}
+
+// parseTURNUsers parses a comma separated list of user=password pairs
+func parseTURNUsers(value string) (map[string]string, error) {
+	users := make(map[string]string)
+	if value == "" {
+		return users, nil
+	}
+	for _, pair := range strings.Split(value, ",") {
+		user, pass, ok := strings.Cut(pair, "=")
+		if !ok || user == "" || pass == "" {
+			return nil, fmt.Errorf("invalid TURN user %q, expected user=password", pair)
+		}
+		users[user] = pass
+	}
+	return users, nil
+}
+
+// startTURNServer starts the embedded STUN/TURN server described by cfg
+func startTURNServer(cfg TURNConfig) (*turn.Server, error) {
+	if cfg.PublicIP == "" {
+		return nil, fmt.Errorf("-turn-public-ip is required when the TURN server is enabled")
+	}
+	relayIP := net.ParseIP(cfg.PublicIP)
+	if relayIP == nil {
+		return nil, fmt.Errorf("invalid TURN public IP %q", cfg.PublicIP)
+	}
+	if len(cfg.Users) == 0 && cfg.Secret == "" {
+		return nil, fmt.Errorf("the TURN server needs -turn-users or -turn-secret")
+	}
+
+	udpConn, err := net.ListenPacket("udp4", cfg.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on UDP %s: %w", cfg.Addr, err)
+	}
+	tcpListener, err := net.Listen("tcp4", cfg.Addr)
+	if err != nil {
+		udpConn.Close()
+		return nil, fmt.Errorf("failed to listen on TCP %s: %w", cfg.Addr, err)
+	}
+
+	newRelayGenerator := func() turn.RelayAddressGenerator {
+		return &turn.RelayAddressGeneratorStatic{
+			RelayAddress: relayIP,
+			Address:      "0.0.0.0",
+		}
+	}
+
+	server, err := turn.NewServer(turn.ServerConfig{
+		Realm:       cfg.Realm,
+		AuthHandler: turnAuthHandler(cfg),
+		PacketConnConfigs: []turn.PacketConnConfig{
+			{PacketConn: udpConn, RelayAddressGenerator: newRelayGenerator()},
+		},
+		ListenerConfigs: []turn.ListenerConfig{
+			{Listener: tcpListener, RelayAddressGenerator: newRelayGenerator()},
+		},
+	})
+	if err != nil {
+		udpConn.Close()
+		tcpListener.Close()
+		return nil, err
+	}
+	return server, nil
+}
+
+// turnAuthHandler accepts the static users first and then falls back to
+// time-limited credentials signed with the shared secret
+func turnAuthHandler(cfg TURNConfig) turn.AuthHandler {
+	staticKeys := make(map[string][]byte, len(cfg.Users))
+	for user, pass := range cfg.Users {
+		staticKeys[user] = turn.GenerateAuthKey(user, cfg.Realm, pass)
+	}
+
+	var restHandler turn.AuthHandler
+	if cfg.Secret != "" {
+		restHandler = turn.LongTermTURNRESTAuthHandler(cfg.Secret, nil)
+	}
+
+	return func(username, realm string, srcAddr net.Addr) ([]byte, bool) {
+		if key, ok := staticKeys[username]; ok {
+			return key, true
+		}
+		if restHandler != nil {
+			return restHandler(username, realm, srcAddr)
+		}
+		slog.Warn("TURN auth rejected", "username", username, "remote_addr", srcAddr.String())
+		return nil, false
+	}
+}
+
+// ICEServersFor returns the embedded server's STUN URL and, with a shared
+// secret, its TURN URLs along with time-limited credentials for peerID.
+// Static users are never handed out: anyone can open a WebSocket, and their
+// passwords would turn the relay into an open one.
+func (cfg TURNConfig) ICEServersFor(peerID string) ([]ICEServer, error) {
+	host := cfg.Host
+	if host == "" {
+		host = cfg.PublicIP
+	}
+	_, port, err := net.SplitHostPort(cfg.Addr)
+	if err != nil {
+		return nil, err
+	}
+	hostPort := net.JoinHostPort(host, port)
+
+	servers := []ICEServer{{URLs: []string{"stun:" + hostPort}}}
+	if cfg.Secret == "" {
+		return servers, nil
+	}
+
+	turnServer := ICEServer{
+		URLs: []string{
+			"turn:" + hostPort + "?transport=udp",
+			"turn:" + hostPort + "?transport=tcp",
+		},
+	}
+	turnServer.Username, turnServer.Credential, err = turn.GenerateLongTermTURNRESTCredentials(cfg.Secret, peerID, cfg.CredentialTTL)
+	if err != nil {
+		return nil, err
+	}
+	return append(servers, turnServer), nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Error codes sent back to clients whose messages are rejected
+const (
+	ErrCodeInvalidMessage = "invalid-message"
+	ErrCodeUnknownType    = "unknown-type"
+	ErrCodeRateLimited    = "rate-limited"
+)
+
+// Inbound message limits, set from flags
+var (
+	maxMessageSize int64   = 64 << 10 // Largest frame a client may send, in bytes
+	messageRate    float64 = 20       // Sustained messages per second per connection
+	messageBurst           = 50       // Messages a connection may send in a burst
+)
+
+// A client flooding the server is told it is rate limited at most once per
+// rateLimitWindow, and disconnected once it has kept at it for
+// rateLimitStrikes windows in a row
+const (
+	rateLimitWindow  = time.Second
+	rateLimitStrikes = 5
+)
+
+var errUnknownType = errors.New("unknown message type")
+
+// messageLimiter applies the message rate limit to one connection
+type messageLimiter struct {
+	limiter    *rate.Limiter
+	lastNotice time.Time // When the client was last told it is rate limited
+	strikes    int       // Consecutive windows in which messages were dropped
+}
+
+func newMessageLimiter() *messageLimiter {
+	return &messageLimiter{limiter: rate.NewLimiter(rate.Limit(messageRate), messageBurst)}
+}
+
+// check reports whether a message received at now may be relayed, and for
+// one that may not, whether to send the client a rate-limited error or to
+// disconnect it
+func (l *messageLimiter) check(now time.Time) (allow, notify, disconnect bool) {
+	if l.limiter.AllowN(now, 1) {
+		return true, false, false
+	}
+	since := now.Sub(l.lastNotice)
+	if since < rateLimitWindow {
+		return false, false, false
+	}
+	if since < 2*rateLimitWindow {
+		l.strikes++
+	} else {
+		l.strikes = 1
+	}
+	l.lastNotice = now
+	if l.strikes >= rateLimitStrikes {
+		return false, false, true
+	}
+	return false, true, false
+}
+
+// sessionDescription is the payload of "offer" and "answer" messages
+type sessionDescription struct {
+	Type string `json:"type"`
+	SDP  string `json:"sdp"`
+}
+
+// iceCandidate is the payload of "candidate" messages
+type iceCandidate struct {
+	Candidate string `json:"candidate"`
+}
+
+// validateMessage checks that msg is one of the types clients may send and
+// that its payload has the expected shape. Everything else is generated by
+// the server.
+func validateMessage(msg Message) error {
+	switch msg.Type {
+	case "offer", "answer":
+		var desc sessionDescription
+		if err := json.Unmarshal(msg.Data, &desc); err != nil {
+			return fmt.Errorf("invalid %s payload: %w", msg.Type, err)
+		}
+		if desc.Type != msg.Type || desc.SDP == "" {
+			return fmt.Errorf("%s must carry a session description of type %s", msg.Type, msg.Type)
+		}
+	case "candidate":
+		var candidate iceCandidate
+		if err := json.Unmarshal(msg.Data, &candidate); err != nil {
+			return fmt.Errorf("invalid candidate payload: %w", err)
+		}
+	case "":
+		return errors.New("missing message type")
+	default:
+		return fmt.Errorf("%w %q", errUnknownType, msg.Type)
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestValidateMessage(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		msg     Message
+		wantErr bool
+		unknown bool // Rejected as an unknown type
+	}{
+		{name: "offer", msg: Message{Type: "offer", Data: json.RawMessage(`{"type":"offer","sdp":"v=0"}`)}},
+		{name: "answer", msg: Message{Type: "answer", Data: json.RawMessage(`{"type":"answer","sdp":"v=0"}`)}},
+		{name: "candidate", msg: Message{Type: "candidate", Data: json.RawMessage(`{"candidate":"candidate:1 1 udp 2130706431 10.0.0.1 5000 typ host"}`)}},
+		{name: "end of candidates", msg: Message{Type: "candidate", Data: json.RawMessage(`{"candidate":""}`)}},
+		{name: "offer carrying an answer", msg: Message{Type: "offer", Data: json.RawMessage(`{"type":"answer","sdp":"v=0"}`)}, wantErr: true},
+		{name: "offer without SDP", msg: Message{Type: "offer", Data: json.RawMessage(`{"type":"offer"}`)}, wantErr: true},
+		{name: "offer without data", msg: Message{Type: "offer"}, wantErr: true},
+		{name: "answer that isn't an object", msg: Message{Type: "answer", Data: json.RawMessage(`"v=0"`)}, wantErr: true},
+		{name: "candidate that isn't an object", msg: Message{Type: "candidate", Data: json.RawMessage(`[1]`)}, wantErr: true},
+		{name: "no type", msg: Message{Data: json.RawMessage(`{}`)}, wantErr: true},
+		{name: "server-only type", msg: Message{Type: "peer-joined"}, wantErr: true, unknown: true},
+		{name: "made-up type", msg: Message{Type: "chat"}, wantErr: true, unknown: true},
+	} {
+		err := validateMessage(tt.msg)
+		if (err != nil) != tt.wantErr || errors.Is(err, errUnknownType) != tt.unknown {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+	}
+}
+
+func TestMessageLimiter(t *testing.T) {
+	oldRate, oldBurst := messageRate, messageBurst
+	messageRate, messageBurst = 10, 5
+	t.Cleanup(func() { messageRate, messageBurst = oldRate, oldBurst })
+
+	l := newMessageLimiter()
+	now := time.Now()
+	for i := range messageBurst {
+		if allow, _, _ := l.check(now); !allow {
+			t.Fatalf("Message %d of the burst dropped", i)
+		}
+	}
+
+	// A flood gets one notice per window, then a disconnect
+	notices, allowed := 0, 0
+	var disconnectedAfter time.Duration
+	for elapsed := time.Millisecond; elapsed < 10*time.Second; elapsed += time.Millisecond {
+		allow, notify, disconnect := l.check(now.Add(elapsed))
+		if allow {
+			allowed++
+		}
+		if notify {
+			notices++
+		}
+		if disconnect {
+			disconnectedAfter = elapsed
+			break
+		}
+	}
+	if limit := int(disconnectedAfter.Seconds()*messageRate) + 1; allowed > limit {
+		t.Errorf("%d messages allowed during the flood, want at most %d", allowed, limit)
+	}
+	if notices != rateLimitStrikes-1 {
+		t.Errorf("%d rate-limited notices, want %d", notices, rateLimitStrikes-1)
+	}
+	if want := (rateLimitStrikes - 1) * rateLimitWindow; disconnectedAfter < want || disconnectedAfter > want+rateLimitWindow {
+		t.Errorf("Disconnected %v into the flood, want after about %v", disconnectedAfter, want)
+	}
+
+	// Exceeding the rate now and then never adds up to a disconnect
+	l = newMessageLimiter()
+	for i := range 20 {
+		burstAt := now.Add(time.Duration(i) * 3 * rateLimitWindow)
+		for range messageBurst + 1 {
+			if _, _, disconnect := l.check(burstAt); disconnect {
+				t.Fatalf("Disconnected for burst %d", i)
+			}
+		}
+	}
+}
+
+func TestMessageLimits(t *testing.T) {
+	_, url := startInstance(t, NewMemoryBroker(), RoomLimits{EmptyGrace: time.Minute})
+
+	t.Run("binary frame", func(t *testing.T) {
+		p := joinPeer(t, url, "room")
+		if err := p.conn.WriteMessage(websocket.BinaryMessage, []byte(`{"type":"offer"}`)); err != nil {
+			t.Fatal(err)
+		}
+		var data ErrorData
+		json.Unmarshal(p.expect("error", "").Data, &data)
+		if data.Code != ErrCodeInvalidMessage {
+			t.Errorf("Error code %q, want %q", data.Code, ErrCodeInvalidMessage)
+		}
+	})
+
+	t.Run("unknown type", func(t *testing.T) {
+		p := joinPeer(t, url, "room")
+		p.send(Message{Type: "roster"})
+		var data ErrorData
+		json.Unmarshal(p.expect("error", "").Data, &data)
+		if data.Code != ErrCodeUnknownType {
+			t.Errorf("Error code %q, want %q", data.Code, ErrCodeUnknownType)
+		}
+	})
+
+	t.Run("flood", func(t *testing.T) {
+		oldRate, oldBurst := messageRate, messageBurst
+		messageRate, messageBurst = 1, 5
+		t.Cleanup(func() { messageRate, messageBurst = oldRate, oldBurst })
+
+		p := joinPeer(t, url, "room")
+		for range 100 {
+			p.send(Message{Type: "candidate", Data: json.RawMessage(`{"candidate":""}`)})
+		}
+		// Count what arrives within the window the flood started in
+		p.conn.SetReadDeadline(time.Now().Add(rateLimitWindow / 2))
+		limited := 0
+		for {
+			var msg Message
+			if err := p.conn.ReadJSON(&msg); err != nil {
+				break
+			}
+			var data ErrorData
+			json.Unmarshal(msg.Data, &data)
+			if data.Code == ErrCodeRateLimited {
+				limited++
+			}
+		}
+		if limited != 1 {
+			t.Errorf("%d rate-limited errors for 100 messages in a burst, want 1", limited)
+		}
+	})
+
+	t.Run("oversized message", func(t *testing.T) {
+		p := joinPeer(t, url, "room")
+		sdp := strings.Repeat("a", int(maxMessageSize))
+		p.send(Message{Type: "offer", Data: json.RawMessage(`{"type":"offer","sdp":"` + sdp + `"}`)})
+		p.conn.SetReadDeadline(time.Now().Add(time.Second))
+		for {
+			_, _, err := p.conn.ReadMessage()
+			if err == nil {
+				continue
+			}
+			if !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+				t.Errorf("Waiting to be disconnected: %v, want close code %d", err, websocket.CloseMessageTooBig)
+			}
+			return
+		}
+	})
+}